@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+
+	"github.com/TheCacophonyProject/csalt/resolver"
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// batchEntry is a device query and the salt command to run on its devices
+type batchEntry struct {
+	Target  string   `yaml:"target"`
+	Command []string `yaml:"command"`
+
+	query *resolver.DeviceQuery
+}
+
+// readBatchFile reads and validates a yaml list of batch entries, reporting
+// every invalid entry
+func readBatchFile(filename string) ([]batchEntry, error) {
+	buf, err := afero.ReadFile(userapi.Fs, filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []batchEntry
+	if err := yaml.UnmarshalStrict(buf, &entries); err != nil {
+		return nil, fmt.Errorf("%v is invalid: %v", filename, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%v has no entries", filename)
+	}
+	var problems []string
+	for i := range entries {
+		entry := &entries[i]
+		if len(entry.Command) == 0 {
+			problems = append(problems, fmt.Sprintf("entry %d has no command", i+1))
+		}
+		query, err := resolver.ParseQuery(entry.Target)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("entry %d: %v", i+1, err))
+		} else if !query.HasValues() {
+			problems = append(problems, fmt.Sprintf("entry %d has no target", i+1))
+		}
+		entry.query = query
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%v is invalid:\n  %v", filename, strings.Join(problems, "\n  "))
+	}
+	return entries, nil
+}
+
+// batchCommands resolves the devices of every entry with a single query and
+// returns the devices for each unique command, in the order the commands are
+// first seen
+func batchCommands(ctx context.Context, r *resolver.Resolver, entries []batchEntry) ([][]string, map[string][]userapi.Device, error) {
+	queries := make([]*resolver.DeviceQuery, len(entries))
+	for i, entry := range entries {
+		queries[i] = entry.query
+	}
+	devices, err := r.ResolveQuery(ctx, resolver.Merge(queries...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var commands [][]string
+	commandDevices := make(map[string][]userapi.Device)
+	for _, entry := range entries {
+		key := strings.Join(entry.Command, "\x00")
+		if _, ok := commandDevices[key]; !ok {
+			commands = append(commands, entry.Command)
+			commandDevices[key] = nil
+		}
+		for _, device := range devices {
+			if entry.query.Matches(device) {
+				commandDevices[key] = append(commandDevices[key], device)
+			}
+		}
+	}
+	return commands, commandDevices, nil
+}
+
+// runBatch runs the commands in a batch file on their devices, each command
+// is run once on all of its devices
+func runBatch(args Args, result *runResult) error {
+	entries, err := readBatchFile(args.FromFile)
+	if err != nil {
+		return err
+	}
+	translate := false
+	for _, entry := range entries {
+		translate = translate || entry.query.HasNames()
+	}
+	r, config, err := newResolver(args, translate)
+	if err != nil {
+		return err
+	}
+	commands, commandDevices, err := batchCommands(context.Background(), r, entries)
+	if err != nil {
+		return err
+	}
+
+	var batchErr error
+	for _, command := range commands {
+		devices := commandDevices[strings.Join(command, "\x00")]
+		if len(devices) == 0 {
+			logger.Warnf("no devices found for %v", strings.Join(command, " "))
+			continue
+		}
+		args.Commands = command
+		if err := runSaltForDevices(r, config, devices, args, result); err != nil {
+			logger.Errorf("%v failed: %v", strings.Join(command, " "), err)
+			if batchErr == nil {
+				batchErr = err
+			}
+		}
+	}
+	return batchErr
+}
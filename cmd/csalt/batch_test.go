@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/TheCacophonyProject/csalt/resolver"
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// memFs replaces userapi.Fs with an in memory filesystem, the returned func
+// restores it
+func memFs() (afero.Fs, func()) {
+	previous := userapi.Fs
+	userapi.Fs = afero.NewMemMapFs()
+	return userapi.Fs, func() {
+		userapi.Fs = previous
+	}
+}
+
+func TestReadBatchFile(t *testing.T) {
+	fs, restore := memFs()
+	defer restore()
+	batch := `
+- target: grp1
+  command: [test.ping]
+- target: "grp2:dev3 #5"
+  command: [cmd.run, uptime]
+`
+	afero.WriteFile(fs, "batch.yaml", []byte(batch), 0600)
+	entries, err := readBatchFile("batch.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Target != "grp2:dev3 #5" ||
+		!reflect.DeepEqual(entries[1].Command, []string{"cmd.run", "uptime"}) ||
+		!reflect.DeepEqual(entries[1].query.SaltIDs, []int{5}) {
+		t.Errorf("readBatchFile() = %+v", entries)
+	}
+}
+
+func TestReadBatchFileInvalid(t *testing.T) {
+	fs, restore := memFs()
+	defer restore()
+	tests := []struct {
+		batch string
+		err   []string
+	}{
+		{"", []string{"has no entries"}},
+		{"target: grp1", []string{"is invalid"}},
+		{"- target: grp1\n  commands: [test.ping]", []string{"is invalid"}},
+		{"- target: grp1\n- command: [test.ping]", []string{"entry 1 has no command", "entry 2 has no target"}},
+	}
+	for _, test := range tests {
+		afero.WriteFile(fs, "batch.yaml", []byte(test.batch), 0600)
+		_, err := readBatchFile("batch.yaml")
+		for _, message := range test.err {
+			if err == nil || !strings.Contains(err.Error(), message) {
+				t.Errorf("readBatchFile(%q) = %v, want %q", test.batch, err, message)
+			}
+		}
+	}
+	if _, err := readBatchFile("missing.yaml"); err == nil {
+		t.Error("reading a missing batch file succeeded")
+	}
+}
+
+func TestBatchCommands(t *testing.T) {
+	fs, restore := memFs()
+	defer restore()
+	batch := `
+- target: grp1:dev1
+  command: [test.ping]
+- target: grp2
+  command: [grains.items]
+- target: "grp1:dev2 #9"
+  command: [test.ping]
+`
+	afero.WriteFile(fs, "batch.yaml", []byte(batch), 0600)
+	entries, err := readBatchFile("batch.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeAPI{devices: testDevices}
+	commands, commandDevices, err := batchCommands(context.Background(), resolver.New(api, "pi"), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"test.ping"}, {"grains.items"}}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %v, want %v", commands, want)
+	}
+	want := map[string][]userapi.Device{
+		"test.ping":    {testDevices[0], testDevices[1], {SaltId: 9}},
+		"grains.items": {testDevices[2]},
+	}
+	if !reflect.DeepEqual(commandDevices, want) {
+		t.Errorf("devices = %v, want %v", commandDevices, want)
+	}
+	if api.calls != 1 {
+		t.Errorf("the API was called %d times, the entries should be resolved together", api.calls)
+	}
+}
+
+func TestRunMainBatch(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	batchFile := path.Join(env.dir, "batch.yaml")
+	writeFile(t, batchFile, "- target: grp1\n  command: [test.ping]\n- target: grp2\n  command: [grains.items]\n", 0600)
+	_, _, result, err := env.run(t, "--from-file", batchFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-1 pi-2][test.ping]`, `[-L][pi-3][grains.items]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+	if !reflect.DeepEqual(result.Devices, testDevices) {
+		t.Errorf("ran on %v", result.Devices)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const bashCompletion = `_csalt() {
+    local cur
+    if declare -F _get_comp_words_by_ref >/dev/null; then
+        _get_comp_words_by_ref -n : cur
+    else
+        cur="${COMP_WORDS[COMP_CWORD]}"
+    fi
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -W "$(csalt --complete-devices 2>/dev/null)" -- "$cur"))
+    fi
+    if declare -F __ltrim_colon_completions >/dev/null; then
+        __ltrim_colon_completions "$cur"
+    fi
+}
+complete -F _csalt csalt
+`
+
+const zshCompletion = `#compdef csalt
+_csalt() {
+    local -a devices
+    if [[ "$PREFIX" == -* ]]; then
+        compadd -- %s
+    else
+        devices=(${(f)"$(csalt --complete-devices 2>/dev/null)"})
+        compadd -- $devices
+    fi
+}
+compdef _csalt csalt
+`
+
+// argFlags returns the command line flags defined by Args
+func argFlags() []string {
+	flags := []string{"-h", "--help"}
+	argsType := reflect.TypeOf(Args{})
+	for i := 0; i < argsType.NumField(); i++ {
+		field := argsType.Field(i)
+		tag := field.Tag.Get("arg")
+		if strings.Contains(tag, "positional") || tag == "-" {
+			continue
+		}
+		long := "--" + strings.ToLower(field.Name)
+		for _, option := range strings.Split(tag, ",") {
+			if strings.HasPrefix(option, "--") {
+				long = option
+			} else if strings.HasPrefix(option, "-") {
+				flags = append(flags, option)
+			}
+		}
+		flags = append(flags, long)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// completionScript returns the completion script for shell
+func completionScript(shell string) (string, error) {
+	flags := strings.Join(argFlags(), " ")
+	switch shell {
+	case "bash":
+		return fmt.Sprintf(bashCompletion, flags), nil
+	case "zsh":
+		return fmt.Sprintf(zshCompletion, flags), nil
+	}
+	return "", fmt.Errorf("unsupported shell %v, must be bash or zsh", shell)
+}
+
+// completionTokens returns the group: and group:device tokens for devices
+func completionTokens(devices []userapi.Device) []string {
+	groups := make(map[string]bool)
+	var tokens []string
+	for _, device := range devices {
+		if !groups[device.GroupName] {
+			groups[device.GroupName] = true
+			tokens = append(tokens, device.GroupName+":")
+		}
+		tokens = append(tokens, device.GroupName+":"+device.DeviceName)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// printCompletionDevices prints device completions without prompting the
+// user, nothing is printed if there is no config or token
+func printCompletionDevices(args Args) {
+	config, err := userapi.NewConfig(configOptions(args)...)
+	if err != nil {
+		return
+	}
+	api := userapi.New(config)
+	if !api.HasToken() {
+		return
+	}
+	devices, err := api.ListDevices()
+	if err != nil {
+		return
+	}
+	for _, token := range completionTokens(devices) {
+		fmt.Println(token)
+	}
+}
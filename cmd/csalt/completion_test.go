@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+func TestArgFlags(t *testing.T) {
+	flags := argFlags()
+	for _, flag := range []string{"-h", "--help", "-y", "--yes", "-b", "--batch-size", "--no-prefix", "--group"} {
+		found := false
+		for _, f := range flags {
+			found = found || f == flag
+		}
+		if !found {
+			t.Errorf("argFlags() is missing %v", flag)
+		}
+	}
+	for _, f := range flags {
+		if f == "--deviceinfo" || f == "--commands" || f == "--outputfile" {
+			t.Errorf("argFlags() includes %v", f)
+		}
+	}
+}
+
+func TestCompletionScript(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh"} {
+		script, err := completionScript(shell)
+		if err != nil || !strings.Contains(script, "--from-file") || !strings.Contains(script, "--complete-devices") {
+			t.Errorf("completionScript(%v) = %q, %v", shell, script, err)
+		}
+	}
+	if _, err := completionScript("fish"); err == nil {
+		t.Error("completionScript() for an unsupported shell succeeded")
+	}
+}
+
+func TestCompletionTokens(t *testing.T) {
+	devices := append(testDevices, userapi.Device{GroupName: "grp1", DeviceName: "dev0", SaltId: 4})
+	want := []string{"grp1:", "grp1:dev0", "grp1:dev1", "grp1:dev2", "grp2:", "grp2:dev3"}
+	if tokens := completionTokens(devices); !reflect.DeepEqual(tokens, want) {
+		t.Errorf("completionTokens() = %v, want %v", tokens, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// doctorCheck is the result of one of the doctor checks
+type doctorCheck struct {
+	name string
+	err  error
+	info string
+}
+
+// doctorChecks checks the config, server, token and salt without running
+// salt or asking for anything
+func doctorChecks(args Args) []doctorCheck {
+	var checks []doctorCheck
+	config, err := userapi.NewConfig(configOptions(args)...)
+	if err == nil {
+		err = config.Validate()
+	}
+	checks = append(checks, doctorCheck{name: "config", err: err, info: "valid"})
+	if err != nil {
+		return append(checks, doctorCheck{name: "salt", err: checkSalt(args.SaltPath), info: "found"})
+	}
+
+	api := userapi.New(config)
+	api.SetLogger(logger)
+	err = api.CheckConnection()
+	checks = append(checks, doctorCheck{name: "server", err: err, info: api.ServerURL() + " is reachable"})
+	if err == nil {
+		checks = append(checks, versionCheck(api))
+	}
+
+	tokenCheck := doctorCheck{name: "token", info: "saved for " + api.User()}
+	if err := config.TokenError(); err != nil {
+		tokenCheck.err = err
+	} else if !api.HasToken() {
+		tokenCheck.err = fmt.Errorf("no token is saved for %v", api.User())
+	} else if api.TokenExpired() {
+		expiry, _ := api.TokenExpiry()
+		tokenCheck.err = fmt.Errorf("the token expired at %v", expiry.Local().Format(time.RFC1123))
+	}
+	checks = append(checks, tokenCheck)
+
+	return append(checks, doctorCheck{name: "salt", err: checkSalt(args.SaltPath), info: "found"})
+}
+
+// versionCheck checks the server version is supported, servers that don't
+// report their version pass
+func versionCheck(api *userapi.CacophonyUserAPI) doctorCheck {
+	version, err := api.ServerVersion()
+	if errors.Is(err, userapi.ErrServerVersionUnknown) {
+		return doctorCheck{name: "version", info: "not reported by the server"}
+	} else if err != nil {
+		return doctorCheck{name: "version", err: err}
+	}
+	return doctorCheck{name: "version", err: api.CheckServerVersion(), info: version + " is supported"}
+}
+
+// doctor prints a pass or fail line for each of the doctor checks
+func doctor(args Args) error {
+	failed := 0
+	for _, check := range doctorChecks(args) {
+		if check.err != nil {
+			failed++
+			fmt.Printf("FAIL %-7v %v\n", check.name, check.err)
+		} else {
+			fmt.Printf("PASS %-7v %v\n", check.name, check.info)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testVersionPath = "/api/v1/version"
+
+// newVersionServer returns a server that reports version at testVersionPath
+func newVersionServer(version string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != testVersionPath {
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"version": version})
+	}))
+}
+
+// writeVersionConfig writes a config for serverURL that checks the server
+// version is from 1.0.0 up to 3.0.0
+func (env *testEnv) writeVersionConfig(t *testing.T, serverURL string) {
+	config := fmt.Sprintf("server-url: %v\nuser-name: user\naudit-log: %v\n"+
+		"server-version-path: %v\nmin-server-version: 1.0.0\nmax-server-version: 3.0.0\n",
+		serverURL, env.auditLog(), testVersionPath)
+	writeFile(t, path.Join(env.dir, "csalt", "cacophony-user.yaml"), config, 0600)
+}
+
+func TestDoctor(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	server := newVersionServer("1.0.0")
+	defer server.Close()
+	env.writeVersionConfig(t, server.URL)
+
+	stdout, _, _, err := env.run(t, "--doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "PASS config  valid\n" +
+		"PASS server  " + server.URL + " is reachable\n" +
+		"PASS version 1.0.0 is supported\n" +
+		"PASS token   saved for user\n" +
+		"PASS salt    found\n"
+	if stdout != want {
+		t.Errorf("--doctor printed %q, want %q", stdout, want)
+	}
+
+	// without server-version-path the version isn't known
+	env.writeConfig(t, server.URL)
+	stdout, _, _, err = env.run(t, "--doctor")
+	if err != nil || !strings.Contains(stdout, "PASS version not reported by the server\n") {
+		t.Errorf("--doctor without server-version-path = %q, %v", stdout, err)
+	}
+}
+
+func TestDoctorFailures(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	server := newVersionServer("9.0.0")
+	defer server.Close()
+	env.writeVersionConfig(t, server.URL)
+	lookPath = func(file string) (string, error) {
+		return "", errors.New("not found")
+	}
+
+	stdout, _, result, err := env.run(t, "--doctor")
+	if err == nil || err.Error() != "2 checks failed" || result.ExitCode != internalErrorCode {
+		t.Errorf("--doctor = %d, %v", result.ExitCode, err)
+	}
+	for _, line := range []string{"FAIL version", "PASS token", "FAIL salt    sudo is required"} {
+		if !strings.Contains(stdout, line) {
+			t.Errorf("--doctor printed %q, missing %q", stdout, line)
+		}
+	}
+
+	server.Close()
+	stdout, _, _, err = env.run(t, "--doctor")
+	if err == nil || !strings.Contains(stdout, "FAIL server") || strings.Contains(stdout, "version") {
+		t.Errorf("--doctor with the server down = %q, %v", stdout, err)
+	}
+}
+
+func TestDoctorWithoutConfig(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	writeFile(t, path.Join(env.dir, "csalt", "cacophony-user.yaml"), "", 0600)
+
+	stdout, _, _, err := env.run(t, "--doctor")
+	if err == nil || !strings.HasPrefix(stdout, "FAIL config") || !strings.HasSuffix(stdout, "PASS salt    found\n") {
+		t.Errorf("--doctor without a config = %q, %v", stdout, err)
+	}
+}
@@ -16,216 +16,1465 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/howeyc/gopass"
+	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/TheCacophonyProject/csalt/resolver"
 	"github.com/TheCacophonyProject/csalt/userapi"
 	"github.com/alexflint/go-arg"
 )
 
 const (
-	maxPasswordAttempts = 3
+	confirmThreshold = 5
+	textLogFormat    = "text"
+	jsonLogFormat    = "json"
+	// noCommandErrorCode is the exit status when there is no command to run
+	noCommandErrorCode = 123
+	// noDevicesErrorCode is the exit status when no devices are found
+	noDevicesErrorCode = 124
+	// internalErrorCode is the exit status for other errors not from salt
+	internalErrorCode = 125
 )
 
-type DeviceQuery struct {
-	devices []userapi.Device
-	groups  []string
-	rawArg  string
-}
+var compoundSaltID = regexp.MustCompile(`#(\d+)\b`)
 
-func (devQ *DeviceQuery) HasValues() bool {
-	return len(devQ.devices) > 0 || len(devQ.groups) > 0
-}
+// saltFunction matches salt module.function names such as test.ping
+var saltFunction = regexp.MustCompile(`^[a-z_][a-z0-9_]*\.[a-z_][a-z0-9_]*$`)
 
-func (devQ *DeviceQuery) UnmarshalText(b []byte) error {
-	devQ.rawArg = string(b)
-	devices := strings.Split(strings.TrimSpace(string(b)), " ")
+// version, commit and date are set at build time by goreleaser with
+// -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
 
-	for _, devInfo := range devices {
-		pos := strings.Index(devInfo, ":")
-		if pos >= 0 {
-			if len(devInfo) == pos+1 {
-				devQ.groups = append(devQ.groups, devInfo[:pos])
-			} else {
-				devQ.devices = append(devQ.devices, userapi.Device{
-					GroupName:  devInfo[:pos],
-					DeviceName: devInfo[pos+1:]})
-			}
-		} else {
-			devQ.groups = append(devQ.groups, devInfo)
-		}
-	}
-	return nil
+type Args struct {
+	Verbose         bool                 `arg:"-v" help:"verbosity level"`
+	NoColor         bool                 `arg:"--no-color" help:"don't color warnings and errors"`
+	Quiet           bool                 `arg:"-q" help:"only print errors, salt's output and prompts"`
+	LogFormat       string               `arg:"--log-format" help:"text or json, json writes each message as a line of json"`
+	List            bool                 `arg:"-l" help:"list all groups and devices you have access to"`
+	FromFile        string               `arg:"--from-file" help:"yaml file of targets and the command to run on each"`
+	Last            bool                 `arg:"--last" help:"run the command on the devices from the last query, all arguments are the command"`
+	Compound        bool                 `arg:"-C" help:"pass the query to salt as a compound target, #<saltid> is expanded to a minion id"`
+	Yes             bool                 `arg:"-y" help:"don't ask for confirmation when running on many devices"`
+	NoCache         bool                 `arg:"--no-cache" help:"don't use or save cached devices"`
+	Refresh         bool                 `arg:"--refresh" help:"ignore cached devices and update the cache"`
+	User            string               `arg:"-u" help:"user name to authenticate as instead of the configured user"`
+	Server          string               `arg:"-s" help:"API server url to use instead of the configured server"`
+	Ephemeral       bool                 `arg:"--ephemeral" help:"authenticate every run and don't save the token"`
+	Insecure        bool                 `arg:"--insecure" help:"don't verify the API server's certificate, only for test servers"`
+	APITimeout      time.Duration        `arg:"--api-timeout" help:"how long each request to the API server may take e.g. 10s"`
+	NoPrefix        bool                 `arg:"--no-prefix" help:"use salt ids as minion ids without a prefix"`
+	ProxyURL        string               `arg:"--proxy-url" help:"proxy to reach the API server through instead of the environment's proxy"`
+	AuditLog        string               `arg:"--audit-log" help:"file to record the salt commands run in"`
+	TokenTTL        string               `arg:"--token-ttl" help:"how long saved tokens last, short, medium or long"`
+	TTL             time.Duration        `arg:"--ttl" help:"how long saved tokens should last e.g. 8h, rounded to short, medium or long"`
+	MaxAttempts     int                  `arg:"--max-password-attempts" help:"number of times to ask for a password"`
+	GroupsOnly      bool                 `arg:"--groups-only" help:"print the group:device names the query resolves to instead of running salt"`
+	GroupBy         bool                 `arg:"--group-by" help:"print the devices from --groups-only under their group"`
+	Count           bool                 `arg:"--count" help:"print the number of devices the query resolves to instead of running salt"`
+	AsNodegroup     string               `arg:"--as-nodegroup" help:"print the devices as a salt nodegroup with this name"`
+	Format          string               `arg:"--format" help:"go template to print each device with when listing devices or using --groups-only"`
+	Completion      string               `arg:"--completion" help:"print a shell completion script for bash or zsh"`
+	CompleteDevices bool                 `arg:"--complete-devices" help:"print group and device names for shell completion"`
+	Whoami          bool                 `arg:"--whoami" help:"check the saved token and show who it authenticates as"`
+	Relogin         bool                 `arg:"--relogin" help:"ask for a password and save a new token even if the saved token is valid"`
+	RefreshToken    bool                 `arg:"--refresh-token" help:"save a new token now instead of waiting for it to expire"`
+	Login           bool                 `arg:"--login" help:"authenticate and save a new token then exit, the password can be set in CSALT_PASSWORD"`
+	Doctor          bool                 `arg:"--doctor" help:"check the config, server, token and salt are set up"`
+	ForceUnlock     bool                 `arg:"--force-unlock" help:"check for lock files held by another csalt or left behind by a csalt that was killed"`
+	Check           bool                 `arg:"--check" help:"check the API server can be reached"`
+	SaltPath        string               `arg:"--salt-path" help:"path of the salt command"`
+	Async           bool                 `arg:"--async" help:"run salt asynchronously"`
+	SkipOffline     bool                 `arg:"--skip-offline" help:"don't run salt on devices that haven't connected recently"`
+	Capture         bool                 `arg:"--capture" help:"capture salt's stdout and stderr and print them as json"`
+	ShowTargets     bool                 `arg:"--show-targets" help:"print the minion id of each device before running salt"`
+	ShowCommand     bool                 `arg:"--show-command" help:"print the salt command that is run so it can be run again by hand"`
+	BatchSize       int                  `arg:"-b,--batch-size" help:"run salt on this many devices at a time"`
+	SaltTimeout     int                  `arg:"--salt-timeout" help:"seconds salt waits for devices to return, passed to salt as -t"`
+	ChunkSize       int                  `arg:"--chunk-size" help:"run salt separately for every this many devices"`
+	Group           []string             `arg:"--group,separate" help:"group to run on, can be repeated, all arguments are then the command"`
+	Device          []string             `arg:"--device,separate" help:"group:device to run on, can be repeated, all arguments are then the command"`
+	Exclude         []string             `arg:"--exclude,separate" help:"group:device to skip, can be repeated"`
+	Repeat          int                  `arg:"--repeat" help:"run the command this many times on the same devices"`
+	Interval        time.Duration        `arg:"--interval" help:"time to wait between runs when using --repeat e.g. 30s"`
+	Strict          bool                 `arg:"--strict" help:"fail instead of warning when devices with different names have the same salt id"`
+	Filter          string               `arg:"--filter" help:"only run on devices with names matching this regular expression"`
+	OutputFile      string               `arg:"--output-file" help:"also write salt's output to this file"`
+	DeviceInfo      resolver.DeviceQuery `arg:"positional"`
+	Commands        []string             `arg:"positional"`
+
+	// outputFile is the opened OutputFile
+	outputFile io.Writer `arg:"-"`
+	// format is the parsed Format template, it is nil if Format isn't set
+	format *template.Template `arg:"-"`
 }
 
-type Args struct {
-	Verbose    bool        `arg:"-v" help:"verbosity level"`
-	DeviceInfo DeviceQuery `arg:"positional"`
-	Commands   []string    `arg:"positional"`
+// Version is printed by --version
+func (Args) Version() string {
+	return fmt.Sprintf("csalt %v (commit %v, built %v) %v %v/%v",
+		version, commit, date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 }
 
+// logger writes everything to stderr, stdout is only used for salt's output
+// and for the results of commands such as --list so they can be piped
+var logger userapi.Logger = userapi.NewStdLogger(os.Stderr, os.Stderr, false)
+
 func procArgs() Args {
 	var args Args
-	args.DeviceInfo = DeviceQuery{}
-	arg.MustParse(&args)
+	args.DeviceInfo = resolver.DeviceQuery{}
+	args.SaltPath = "salt"
+	args.Repeat = 1
+	args.LogFormat = textLogFormat
+	p := arg.MustParse(&args)
+	if args.Verbose && args.Quiet {
+		p.Fail("--verbose and --quiet can't be used together")
+	}
+	if args.LogFormat != textLogFormat && args.LogFormat != jsonLogFormat {
+		p.Fail(fmt.Sprintf("--log-format must be %v or %v", textLogFormat, jsonLogFormat))
+	}
+	if args.Login && args.Ephemeral {
+		p.Fail("--login saves a token so can't be used with --ephemeral")
+	}
+	if args.TTL != 0 && args.TokenTTL != "" {
+		p.Fail("--ttl and --token-ttl can't be used together")
+	}
+	if args.TTL < 0 {
+		p.Fail("--ttl must be positive")
+	}
+	for _, name := range args.Exclude {
+		if pos := strings.Index(name, ":"); pos <= 0 || pos == len(name)-1 {
+			p.Fail(fmt.Sprintf("--exclude %v must be in the format <groupname>:<devicename>", name))
+		}
+	}
+	if args.BatchSize < 0 {
+		p.Fail("--batch-size must be positive")
+	}
+	if args.SaltTimeout < 0 {
+		p.Fail("--salt-timeout must be positive")
+	}
+	if args.ChunkSize < 0 {
+		p.Fail("--chunk-size must be positive")
+	}
+	if args.Repeat < 1 {
+		p.Fail("--repeat must be at least 1")
+	}
+	if args.Interval < 0 {
+		p.Fail("--interval must be positive")
+	}
+	if args.Interval > 0 && args.Repeat == 1 {
+		p.Fail("--interval can only be used with --repeat")
+	}
+	if _, err := regexp.Compile(args.Filter); err != nil {
+		p.Fail(fmt.Sprintf("invalid --filter: %v", err))
+	}
+	if args.APITimeout < 0 {
+		p.Fail("--api-timeout must be positive")
+	}
+	format, err := parseFormat(args.Format)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	args.format = format
 	return args
 }
 
-func main() {
-	err := runMain()
+// parseFormat parses the --format template, an empty format returns nil
+func parseFormat(format string) (*template.Template, error) {
+	if format == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("format").Parse(format)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("invalid --format: %v", err)
+	}
+	return tmpl, nil
+}
+
+func main() {
+	result, err := runMain()
+	logger.Debugf("ran on %d devices in %v, exit status %d", len(result.Devices), result.Duration, result.ExitCode)
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		logger.Errorf("%v", err)
+	}
+	os.Exit(result.ExitCode)
+}
+
+// runResult describes what a run of csalt did
+type runResult struct {
+	// Devices are the devices salt was run on
+	Devices []userapi.Device
+	// ExitCode is the exit status of salt, or of csalt if it failed
+	ExitCode int
+	Duration time.Duration
+}
+
+// exitCode returns the exit status for the error returned by a run, salt's
+// exit status is used if salt failed
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return errorCode(err)
+}
+
+// errorCode returns the exit status for an error that isn't from salt
+func errorCode(err error) int {
+	switch {
+	case errors.Is(err, resolver.ErrNoCommand):
+		return noCommandErrorCode
+	case errors.Is(err, resolver.ErrNoDevices):
+		return noDevicesErrorCode
 	}
+	return internalErrorCode
 }
 
-func getPasswordAndAuthenticate(api *userapi.CacophonyUserAPI) error {
-	attempts := 0
-	fmt.Printf("Authentication is required for %v\n", api.User())
-	fmt.Print("Enter Password: ")
-	for !api.IsAuthenticated() {
-		bytePassword, err := gopass.GetPasswd()
+// passwordEnv is the environment variable a password can be read from
+// instead of prompting, for running without a terminal
+const passwordEnv = "CSALT_PASSWORD"
+
+// requestAuthentication prompts for the users password until it
+// authenticates or maxAttempts is reached, if passwordEnv is set it is used
+// instead of prompting
+func requestAuthentication(api userapi.API, maxAttempts int) error {
+	if password, ok := os.LookupEnv(passwordEnv); ok {
+		logger.Debugf("authenticating %v with the password from %v", api.User(), passwordEnv)
+		return api.Authenticate(password)
+	}
+	logger.Infof("Authentication is required for %v", api.User())
+	fmt.Fprint(os.Stderr, "Enter Password: ")
+	for attempts := 1; ; attempts++ {
+		bytePassword, err := gopass.GetPasswdPrompt("", false, os.Stdin, os.Stderr)
 		if err != nil {
 			return err
 		}
 		err = api.Authenticate(string(bytePassword))
 		if err == nil {
-			break
+			return nil
 		} else if !userapi.IsAuthenticationError(err) {
 			return err
 		}
-		attempts += 1
-		if attempts == maxPasswordAttempts {
+		if attempts >= maxAttempts {
 			return errors.New("Max Password Attempts")
 		}
-		fmt.Print("\nIncorrect user/password try again\nEnter Password: ")
+		fmt.Fprint(os.Stderr, "\nIncorrect user/password try again\nEnter Password: ")
+	}
+}
+
+// authenticateUser authenticates with a password and saves a temporary token,
+// unless another process saves a new token while waiting for the refresh lock
+func authenticateUser(api userapi.API, config *userapi.Config) error {
+	unlock, err := api.LockTokenRefresh()
+	if err != nil {
+		logger.Debugf("could not lock token refresh %v", err)
+	} else {
+		defer unlock()
+		if api.ReloadToken() {
+			return nil
+		}
+	}
+	return login(api, config)
+}
+
+// login authenticates with a password and saves a temporary token
+func login(api userapi.API, config *userapi.Config) error {
+	if mismatch := config.TokenMismatch(); mismatch != "" {
+		logger.Warnf("%v", mismatch)
+	}
+	if err := requestAuthentication(api, config.MaxPasswordAttempts); err != nil {
+		return err
 	}
-	return api.SaveTemporaryToken(userapi.LongTTL)
+	if config.NoSaveToken {
+		return nil
+	}
+	return api.SaveTemporaryToken(config.TokenTTL)
 }
 
 // getMissingConfig from the user and save to config file
 func getMissingConfig(conf *userapi.Config) {
-	fmt.Print("User configuration missing\n")
+	logger.Infof("User configuration missing")
 	if conf.ServerURL == "" {
-		fmt.Print("Enter API ServerURL: ")
+		fmt.Fprint(os.Stderr, "Enter API ServerURL: ")
 		fmt.Scanln(&conf.ServerURL)
 	}
 
 	if conf.UserName == "" {
-		fmt.Print("Enter Username: ")
+		fmt.Fprint(os.Stderr, "Enter Username: ")
 		fmt.Scanln(&conf.UserName)
 	}
 }
 
-func getSaltPrefix(serverURL string) string {
-	idPrefix := "pi"
-	url, err := url.Parse(serverURL)
-	if err != nil {
-		fmt.Printf("Error parsing serverURL %v", err)
-		return idPrefix
+// isTerminal returns true if f is a terminal, other character devices such
+// as /dev/null aren't terminals
+func isTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// confirmDevices asks the user to type yes before running on more than
+// confirmThreshold devices
+func confirmDevices(in io.Reader, interactive bool, count int) error {
+	if count <= confirmThreshold {
+		return nil
 	}
-	if url.Host == userapi.TestAPIHost {
-		idPrefix += "-test"
+	if !interactive {
+		return fmt.Errorf("refusing to run on %d devices without confirmation, use --yes", count)
 	}
-	return idPrefix
+	fmt.Fprintf(os.Stderr, "This will run on %d devices, type yes to continue: ", count)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("Cancelled")
+	}
+	return nil
 }
 
-func saltDeviceString(serverURL string, devices []userapi.Device) string {
-	var saltDevices bytes.Buffer
-	idPrefix := getSaltPrefix(serverURL)
-	saltDevices.WriteString("\"")
-	spacer := ""
+func runSaltForDevices(r *resolver.Resolver, config *userapi.Config, devices []userapi.Device, args Args, result *runResult) error {
+	devices, invalid := resolver.ValidDevices(devices)
+	for _, device := range invalid {
+		logger.Warnf("skipping %v which has no salt id", deviceName(device))
+	}
+	if err := duplicateSaltIDs(devices); err != nil {
+		if args.Strict {
+			return err
+		}
+		logger.Warnf("%v", err)
+	}
+	devices = userapi.UniqueSaltIDs(userapi.UniqueDevices(devices))
+	if len(args.Exclude) > 0 {
+		devices = excludeDevices(devices, args.Exclude)
+	}
+	if args.Filter != "" {
+		devices = filterDevices(devices, regexp.MustCompile(args.Filter))
+	}
+	if args.SkipOffline {
+		devices = onlineDevices(devices)
+	}
+	logField("devices", len(devices))
+	if len(devices) == 0 {
+		return resolver.ErrNoDevices
+	}
+	if !args.Yes && !config.IsSafeCommand(args.Commands[0]) {
+		if err := confirmDevices(os.Stdin, isTerminal(os.Stdin), len(devices)); err != nil {
+			return err
+		}
+	}
+	result.Devices = append(result.Devices, devices...)
+	if args.ShowTargets {
+		printTargets(r, devices)
+	}
+	chunks := chunkDevices(devices, args.ChunkSize)
+	checkTargetLength(r, chunks, config.MaxTargetLength)
+	start := time.Now()
+	var saltErr error
+	for run := 1; run <= args.Repeat; run++ {
+		if run > 1 {
+			logger.Infof("Repeating, run %d of %d", run, args.Repeat)
+			time.Sleep(args.Interval)
+		}
+		for _, chunk := range chunks {
+			commands := append(saltOptions(args), r.SaltArgs(chunk)...)
+			commands = append(commands, args.Commands...)
+			if err := config.WriteAuditLog(r.MinionIDs(chunk), commands); err != nil {
+				return fmt.Errorf("could not write audit log: %v", err)
+			}
+			if err := runSalt(args, commands...); err != nil {
+				logger.Debugf("salt failed for %v devices: %v", len(chunk), err)
+				if saltErr == nil {
+					saltErr = err
+				}
+			}
+		}
+	}
+	printSaltSummary(len(devices), args.Commands, time.Since(start))
+	return saltErr
+}
+
+// printTargets logs the minion id that each device is run on
+func printTargets(r *resolver.Resolver, devices []userapi.Device) {
+	for i, id := range r.MinionIDs(devices) {
+		logger.Infof("%v -> %v", deviceName(devices[i]), id)
+	}
+}
+
+// printSaltSummary logs a line saying command was run on count devices and
+// how long it took, so it can be found after lots of salt output
+func printSaltSummary(count int, command []string, elapsed time.Duration) {
+	logger.Infof("Ran %v on %d devices in %v", strings.Join(command, " "), count, elapsed.Round(time.Millisecond))
+}
+
+// chunkDevices splits devices into chunks of at most size devices, a size of
+// zero returns all devices in one chunk
+func chunkDevices(devices []userapi.Device, size int) [][]userapi.Device {
+	if size <= 0 || len(devices) <= size {
+		return [][]userapi.Device{devices}
+	}
+	var chunks [][]userapi.Device
+	for len(devices) > size {
+		chunks = append(chunks, devices[:size])
+		devices = devices[size:]
+	}
+	return append(chunks, devices)
+}
+
+// checkTargetLength warns if the salt target for any chunk is longer than
+// maxLength, as salt may fail to start with a very long argument
+func checkTargetLength(r *resolver.Resolver, chunks [][]userapi.Device, maxLength int) {
+	for _, chunk := range chunks {
+		if length := len(r.SaltDeviceString(chunk)); length > maxLength {
+			logger.Warnf("the salt target for %d devices is %d characters which may be too long to run, use --chunk-size to run on fewer devices at a time", len(chunk), length)
+			return
+		}
+	}
+}
+
+// duplicateSaltIDs returns an error listing the salt ids that are used by
+// devices with different names, or nil if there are none. Devices given only
+// by salt id have no name so aren't compared
+func duplicateSaltIDs(devices []userapi.Device) error {
+	names := make(map[int]string)
+	var duplicates []string
+	for _, device := range devices {
+		if device.DeviceName == "" {
+			continue
+		}
+		name, seen := names[device.SaltId]
+		if !seen {
+			names[device.SaltId] = deviceName(device)
+		} else if !strings.EqualFold(name, deviceName(device)) {
+			duplicates = append(duplicates, fmt.Sprintf("#%d is used by %v and %v", device.SaltId, name, deviceName(device)))
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	return fmt.Errorf("devices have the same salt id, salt will only run once for each: %v", strings.Join(duplicates, ", "))
+}
+
+// filterDevices returns the devices with names matching filter, printing how
+// many matched
+func filterDevices(devices []userapi.Device, filter *regexp.Regexp) []userapi.Device {
+	var matched []userapi.Device
 	for _, device := range devices {
-		saltDevices.WriteString(spacer + idPrefix + "-" + strconv.Itoa(device.SaltId))
-		spacer = " "
+		if filter.MatchString(device.DeviceName) {
+			matched = append(matched, device)
+		}
 	}
-	saltDevices.WriteString("\"")
-	return saltDevices.String()
+	logger.Infof("%d of %d devices match --filter %v", len(matched), len(devices), filter)
+	return matched
 }
 
-func runSaltForDevices(serverURL string, devices []userapi.Device, argCommands []string) error {
-	if len(devices) == 0 {
-		return errors.New("No valid devices found")
+// excludeDevices returns devices without the group:device names in exclude,
+// printing the devices that are excluded and warning about excluded names
+// that don't match a device
+func excludeDevices(devices []userapi.Device, exclude []string) []userapi.Device {
+	found := make(map[string]bool)
+	var included []userapi.Device
+	for _, device := range devices {
+		excluded := false
+		for _, name := range exclude {
+			if strings.EqualFold(deviceName(device), name) {
+				excluded = true
+				found[name] = true
+			}
+		}
+		if excluded {
+			logger.Infof("Excluding %v", deviceName(device))
+		} else {
+			included = append(included, device)
+		}
 	}
-	ids := saltDeviceString(serverURL, devices)
-	commands := make([]string, 2, 10)
-	if len(devices) > 1 {
-		commands = append(commands, "-L")
+	for _, name := range exclude {
+		if !found[name] {
+			logger.Warnf("excluded device %v was not found", name)
+		}
 	}
-	commands = append(commands, ids)
-	commands = append(commands, argCommands...)
-	return runSalt(commands...)
+	return included
 }
 
-func runSalt(commands ...string) error {
-	commands = append([]string{"salt"}, commands...)
-	cmd := exec.Command("sudo", commands...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+// onlineDevices returns the devices that are online, printing the devices
+// that are skipped
+func onlineDevices(devices []userapi.Device) []userapi.Device {
+	var online []userapi.Device
+	for _, device := range devices {
+		if device.Online() {
+			online = append(online, device)
+		} else {
+			logger.Infof("Skipping %v, last seen %v", deviceName(device), device.LastSeen.Local().Format(time.RFC1123))
+		}
+	}
+	return online
+}
 
-	out, err := cmd.Output()
-	if err != nil {
-		fmt.Println(err)
+// saltOptions returns the salt options supplied as arguments, these must come
+// before the target
+func saltOptions(args Args) []string {
+	var options []string
+	if args.Async {
+		options = append(options, "--async")
+	}
+	if args.BatchSize > 0 {
+		options = append(options, "-b", strconv.Itoa(args.BatchSize))
+	}
+	if args.SaltTimeout > 0 {
+		options = append(options, "-t", strconv.Itoa(args.SaltTimeout))
 	}
+	return options
+}
 
-	if err != nil {
-		return err
+// compoundSaltArgs returns the salt arguments to run commands against a
+// compound target, expanding any #<saltid> to a minion id
+func compoundSaltArgs(idPrefix, target string, argCommands []string) []string {
+	replacement := "$1"
+	if idPrefix != "" {
+		replacement = idPrefix + "-$1"
+	}
+	target = compoundSaltID.ReplaceAllString(target, replacement)
+	return append([]string{"-C", target}, argCommands...)
+}
+
+func runCompound(args Args) error {
+	target := args.DeviceInfo.RawArg
+	argCommands := args.Commands
+	if len(argCommands) == 0 {
+		return resolver.ErrNoCommand
+	}
+	idPrefix := ""
+	if compoundSaltID.MatchString(target) {
+		r, _, err := newResolver(args, false)
+		if err != nil {
+			return err
+		}
+		idPrefix = r.Prefix
+	}
+	commands := append(saltOptions(args), compoundSaltArgs(idPrefix, target, argCommands)...)
+	return runSalt(args, commands...)
+}
+
+// runSalt runs salt with commands, streaming its output or printing it as a
+// json saltOutput if capturing
+func runSalt(args Args, commands ...string) error {
+	stdout, stderr := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	if args.outputFile != nil {
+		stdout = io.MultiWriter(stdout, args.outputFile)
+		stderr = io.MultiWriter(stderr, args.outputFile)
+	}
+	if args.ShowCommand {
+		logger.Infof("%v", shellCommand(append([]string{"sudo", args.SaltPath}, commands...)))
+	}
+	if !args.Capture {
+		return streamSalt(args.SaltPath, stdout, stderr, commands...)
+	}
+	output, err := captureSalt(args.SaltPath, commands...)
+	if output != nil {
+		if err := json.NewEncoder(stdout).Encode(output); err != nil {
+			return err
+		}
 	}
-	fmt.Print(string(out))
 	return err
 }
 
-func runMain() error {
-	args := procArgs()
-	if len(args.Commands) == 0 {
-		if len(args.DeviceInfo.rawArg) == 0 {
-			return errors.New("A command must be specified")
+// lookPath is exec.LookPath, it can be replaced to check for salt without
+// searching PATH
+var lookPath = exec.LookPath
+
+// checkSalt returns an error if sudo or salt can't be found, this is checked
+// before authenticating so a password isn't asked for when salt can't be run
+func checkSalt(saltPath string) error {
+	if _, err := lookPath("sudo"); err != nil {
+		return fmt.Errorf("sudo is required to run salt: %v", err)
+	}
+	if _, err := lookPath(saltPath); err != nil {
+		return fmt.Errorf("salt could not be found at %v, install salt or use --salt-path: %v", saltPath, err)
+	}
+	return nil
+}
+
+// shellSafe matches arguments that don't need quoting in a shell
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellCommand returns args as a command that can be pasted into a shell,
+// quoting arguments that contain spaces or shell characters
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
 		} else {
-			return runSalt(args.DeviceInfo.rawArg)
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
 		}
 	}
-	if !args.DeviceInfo.HasValues() {
-		return runSalt(args.Commands...)
+	return strings.Join(quoted, " ")
+}
+
+// execCommand is exec.Command, it can be replaced to run a fake salt
+var execCommand = exec.Command
+
+func saltCommand(saltPath string, commands []string) *exec.Cmd {
+	commands = append([]string{saltPath}, commands...)
+	logger.Debugf("running sudo %v", shellCommand(commands))
+	cmd := execCommand("sudo", commands...)
+	cmd.Stdin = os.Stdin
+	return cmd
+}
+
+// streamSalt runs salt with commands writing its output to stdout and stderr
+func streamSalt(saltPath string, stdout, stderr io.Writer, commands ...string) error {
+	cmd := saltCommand(saltPath, commands)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// saltOutput is the captured output of a salt run
+type saltOutput struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit-code"`
+}
+
+// captureSalt runs salt with commands capturing stdout and stderr separately,
+// output is nil if salt couldn't be run and err is an *exec.ExitError if salt
+// exited with a non zero status
+func captureSalt(saltPath string, commands ...string) (*saltOutput, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := saltCommand(saltPath, commands)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, err
 	}
+	return &saltOutput{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+	}, err
+}
 
-	config, err := userapi.NewConfig()
-	if err != nil {
+// printDevices prints devices as a tree sorted by group then device name,
+// devices supplied by salt id are printed under a salt ids heading
+func printDevices(devices []userapi.Device) {
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].GroupName != devices[j].GroupName {
+			return devices[i].GroupName < devices[j].GroupName
+		}
+		if devices[i].DeviceName != devices[j].DeviceName {
+			return devices[i].DeviceName < devices[j].DeviceName
+		}
+		return devices[i].SaltId < devices[j].SaltId
+	})
+
+	group := ""
+	for i, device := range devices {
+		if i == 0 || device.GroupName != group {
+			group = device.GroupName
+			if group == "" {
+				fmt.Println("salt ids")
+			} else {
+				fmt.Println(group)
+			}
+		}
+		name := device.DeviceName
+		if name == "" {
+			name = "#" + strconv.Itoa(device.SaltId)
+		}
+		fmt.Printf("  %v\n", name)
+	}
+}
+
+// configOptions returns the config overrides supplied as arguments
+func configOptions(args Args) []userapi.ConfigOption {
+	var options []userapi.ConfigOption
+	if args.User != "" {
+		options = append(options, userapi.WithUserName(args.User))
+	}
+	if args.Server != "" {
+		options = append(options, userapi.WithServerURL(args.Server))
+	}
+	if args.AuditLog != "" {
+		options = append(options, userapi.WithAuditLog(args.AuditLog))
+	}
+	if args.Ephemeral {
+		options = append(options, userapi.WithNoSaveToken())
+	}
+	if args.Insecure {
+		options = append(options, userapi.WithInsecureSkipVerify())
+	}
+	if args.NoPrefix {
+		options = append(options, userapi.WithNoPrefix())
+	}
+	if args.APITimeout > 0 {
+		options = append(options, userapi.WithAPITimeout(args.APITimeout))
+	}
+	if args.ProxyURL != "" {
+		options = append(options, userapi.WithProxyURL(args.ProxyURL))
+	}
+	if args.TokenTTL != "" {
+		options = append(options, userapi.WithTokenTTL(args.TokenTTL))
+	}
+	if args.TTL > 0 {
+		options = append(options, userapi.WithTokenTTL(userapi.TTLForDuration(args.TTL)))
+	}
+	if args.MaxAttempts != 0 {
+		options = append(options, userapi.WithMaxPasswordAttempts(args.MaxAttempts))
+	}
+	return options
+}
+
+// loadConfig loads the user config, prompting for the server and user if
+// the config file is missing or empty and they aren't supplied as arguments
+func loadConfig(args Args) (*userapi.Config, error) {
+	options := configOptions(args)
+	config, err := userapi.NewConfig(options...)
+	if err == userapi.ErrConfigMissing || err == userapi.ErrConfigEmpty {
 		getMissingConfig(config)
-		err = config.Save()
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		if args.Server != "" || args.User != "" {
+			// arguments only override the config, they are never saved
+			logger.Infof("Not saving the config as --server or --user was used")
+		} else if err := config.Save(); err != nil {
+			logger.Warnf("Error saving config %v", err)
+		}
+		// the entered values are used even if they couldn't be saved
+		options = append(options, userapi.WithServerURL(config.ServerURL), userapi.WithUserName(config.UserName))
+		config, err = userapi.NewConfig(options...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := config.TokenError(); err != nil {
+		logger.Warnf("ignoring the saved token: %v", err)
+	}
+	if config.InsecureSkipVerify {
+		logger.Warnf("NOT verifying the certificate of %v, connections are insecure", config.ServerURL)
+	}
+	return config, nil
+}
+
+// checkServerVersion warns if the server version isn't supported, the check
+// is skipped quietly if the version isn't known
+func checkServerVersion(api userapi.API) {
+	err := api.CheckServerVersion()
+	if errors.Is(err, userapi.ErrUnsupportedVersion) {
+		logger.Warnf("%v", err)
+	} else if err != nil {
+		logger.Debugf("not checking the server version: %v", err)
+	}
+}
+
+// newAPI returns the api for config, it can be replaced with a fake to run
+// without a server
+var newAPI = func(args Args, config *userapi.Config) userapi.API {
+	api := userapi.New(config)
+	api.SetLogger(logger)
+	logField("server", api.ServerURL())
+	logField("request-id", api.RequestID())
+	if args.NoCache {
+		api.SetCacheMode(userapi.CacheDisabled)
+	} else if args.Refresh {
+		api.SetCacheMode(userapi.CacheRefresh)
+	}
+	return api
+}
+
+// connectAPI loads the user config and returns an api with a token,
+// prompting for a password if required
+func connectAPI(args Args) (*userapi.Config, userapi.API, error) {
+	config, err := loadConfig(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	api := newAPI(args, config)
+	checkServerVersion(api)
+
+	if args.Relogin {
+		api.ClearToken()
+		if err := login(api, config); err != nil {
+			return nil, nil, err
+		}
+	} else if api.NeedsAuthentication() {
+		err = authenticateUser(api, config)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return config, api, nil
+}
+
+// saltPrefix returns the minion id prefix for serverURL, or no prefix if
+// no-prefix is set
+func saltPrefix(config *userapi.Config, serverURL string) string {
+	if config.NoPrefix {
+		return ""
+	}
+	return resolver.SaltPrefix(serverURL, config.MinionPrefixes())
+}
+
+// newResolver returns a resolver for the configured server and the config it
+// uses, connecting to the API if names need to be translated
+func newResolver(args Args, translate bool) (*resolver.Resolver, *userapi.Config, error) {
+	if !translate {
+		config, err := loadConfig(args)
 		if err != nil {
-			fmt.Printf("Error saving config %v", err)
+			return nil, nil, err
 		}
+		return resolver.New(nil, saltPrefix(config, config.ServerURL)), config, nil
+	}
+
+	config, api, err := connectAPI(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := resolver.New(api, saltPrefix(config, api.ServerURL()))
+	r.Authenticate = func() error {
+		return authenticateUser(api, config)
+	}
+	r.MaxAuthAttempts = config.MaxPasswordAttempts
+	return r, config, nil
+}
+
+func listDevices(args Args) error {
+	r, _, err := newResolver(args, true)
+	if err != nil {
+		return err
+	}
+	devices, err := r.ListDevices(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(devices) == 0 {
+		logger.Infof("%v does not have access to any devices", r.API.User())
+		return nil
+	}
+	if args.format != nil {
+		return formatDevices(args.format, devices)
+	}
+	printDevices(devices)
+	return nil
+}
+
+// checkConnection checks the configured server can be reached
+func checkConnection(args Args) error {
+	config, err := loadConfig(args)
+	if err != nil {
+		return err
 	}
 	api := userapi.New(config)
+	api.SetLogger(logger)
+	if err := api.CheckConnection(); err != nil {
+		return fmt.Errorf("could not connect to %v: %v", api.ServerURL(), err)
+	}
+	logger.Infof("Connected to %v", api.ServerURL())
+	checkServerVersion(api)
+	return nil
+}
 
-	if !api.HasToken() {
-		err = getPasswordAndAuthenticate(api)
+// resolveDevices returns the devices matching the device query along with the
+// resolver and config used
+func resolveDevices(args Args) (*resolver.Resolver, *userapi.Config, []userapi.Device, error) {
+	r, config, err := newResolver(args, args.DeviceInfo.HasNames())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	devices, err := r.ResolveQuery(context.Background(), &args.DeviceInfo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if r.API != nil {
+		for _, message := range r.API.Messages() {
+			logger.Infof("Server: %v", message)
+		}
+		picked, err := devicesForUnmatchedGroups(r, &args.DeviceInfo, devices)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
+		}
+		devices = append(devices, picked...)
+	}
+	return r, config, devices, nil
+}
+
+// unmatchedNames returns the groups in query written without a : that none of
+// devices are in, these may be device names given without their group
+func unmatchedNames(query *resolver.DeviceQuery, devices []userapi.Device) []string {
+	var names []string
+	for _, group := range query.BareNames() {
+		matched := false
+		for _, device := range devices {
+			if strings.EqualFold(device.GroupName, group) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			names = append(names, group)
+		}
+	}
+	return names
+}
+
+// devicesForUnmatchedGroups returns the devices named by groups in query that
+// didn't match a group, when a name matches devices in more than one group the
+// user is asked to pick one, or an error is returned if stdin isn't a terminal
+func devicesForUnmatchedGroups(r *resolver.Resolver, query *resolver.DeviceQuery, devices []userapi.Device) ([]userapi.Device, error) {
+	names := unmatchedNames(query, devices)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	// all devices are listed once to look up every name
+	all, err := r.ListDevices(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var picked []userapi.Device
+	for _, name := range names {
+		candidates := namedDevices(all, name)
+		switch {
+		case len(candidates) == 0:
+			continue
+		case len(candidates) == 1:
+			logger.Infof("Using %v for %v", deviceName(candidates[0]), name)
+			picked = append(picked, candidates[0])
+		case !isTerminal(os.Stdin):
+			var matches []string
+			for _, device := range candidates {
+				matches = append(matches, deviceName(device))
+			}
+			return nil, fmt.Errorf("%v matches more than one device, use one of %v", name, strings.Join(matches, ", "))
+		default:
+			device, err := pickDevice(os.Stdin, os.Stderr, name, candidates)
+			if err != nil {
+				return nil, err
+			}
+			picked = append(picked, device)
+		}
+	}
+	return picked, nil
+}
+
+// namedDevices returns the devices named name in any group
+func namedDevices(devices []userapi.Device, name string) []userapi.Device {
+	var named []userapi.Device
+	for _, device := range devices {
+		if strings.EqualFold(device.DeviceName, name) {
+			named = append(named, device)
+		}
+	}
+	return named
+}
+
+// pickDevice asks the user to pick which of candidates they meant by name
+func pickDevice(in io.Reader, out io.Writer, name string, candidates []userapi.Device) (userapi.Device, error) {
+	fmt.Fprintf(out, "%v matches more than one device:\n", name)
+	for i, device := range candidates {
+		fmt.Fprintf(out, "  %d) %v\n", i+1, deviceName(device))
+	}
+	fmt.Fprintf(out, "Enter the number of the device to use: ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return userapi.Device{}, err
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || choice < 1 || choice > len(candidates) {
+		return userapi.Device{}, fmt.Errorf("%q is not one of the devices", strings.TrimSpace(answer))
+	}
+	return candidates[choice-1], nil
+}
+
+// deviceName returns the group:device name of a device, or #<saltid> if the
+// device was supplied by salt id
+func deviceName(device userapi.Device) string {
+	if device.GroupName == "" && device.DeviceName == "" {
+		return "#" + strconv.Itoa(device.SaltId)
+	}
+	return device.GroupName + ":" + device.DeviceName
+}
+
+// printDeviceNames prints the group:device name of each device the query
+// resolves to
+func printDeviceNames(args Args) error {
+	if !args.DeviceInfo.HasValues() {
+		return errors.New("A device query must be specified")
+	}
+	_, _, devices, err := resolveDevices(args)
+	if err != nil {
+		return err
+	}
+	if args.format != nil {
+		return formatDevices(args.format, devices)
+	}
+	if args.GroupBy {
+		printDevices(userapi.UniqueDevices(devices))
+		return nil
+	}
+	for _, device := range devices {
+		fmt.Println(deviceName(device))
+	}
+	return nil
+}
+
+// countDevices prints the number of unique devices the query resolves to
+func countDevices(args Args) error {
+	if !args.DeviceInfo.HasValues() {
+		return errors.New("A device query must be specified")
+	}
+	_, _, devices, err := resolveDevices(args)
+	if err != nil {
+		return err
+	}
+	fmt.Println(len(userapi.UniqueSaltIDs(userapi.UniqueDevices(devices))))
+	return nil
+}
+
+// printNodegroup prints the devices the query resolves to as a salt nodegroup
+func printNodegroup(args Args) error {
+	if !args.DeviceInfo.HasValues() {
+		return errors.New("A device query must be specified")
+	}
+	r, _, devices, err := resolveDevices(args)
+	if err != nil {
+		return err
+	}
+	devices, _ = resolver.ValidDevices(userapi.UniqueSaltIDs(userapi.UniqueDevices(devices)))
+	if len(devices) == 0 {
+		return resolver.ErrNoDevices
+	}
+	fmt.Println(r.Nodegroup(args.AsNodegroup, devices))
+	return nil
+}
+
+// formatDevices prints each device using the --format template
+func formatDevices(tmpl *template.Template, devices []userapi.Device) error {
+	for _, device := range devices {
+		if err := tmpl.Execute(os.Stdout, device); err != nil {
+			return fmt.Errorf("could not format %v: %v", deviceName(device), err)
 		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// whoami prints the details of the user the saved token belongs to
+func whoami(args Args) error {
+	config, err := loadConfig(args)
+	if err != nil {
+		return err
 	}
-	devices, err := api.TranslateNames(args.DeviceInfo.groups, args.DeviceInfo.devices)
+	api := userapi.New(config)
+	api.SetLogger(logger)
+	if api.HasToken() && api.TokenExpired() {
+		expiry, _ := api.TokenExpiry()
+		return fmt.Errorf("the token for %v on %v expired at %v", api.User(), api.ServerURL(), expiry.Local().Format(time.RFC1123))
+	}
+	info, err := api.Whoami()
 	if userapi.IsAuthenticationError(err) {
-		err = getPasswordAndAuthenticate(api)
+		return fmt.Errorf("the token for %v on %v is missing or expired, authenticate by running a query", api.User(), api.ServerURL())
+	} else if err != nil {
+		return err
+	}
 
-		if err != nil {
+	expiry := "never"
+	if !info.TokenExpiry.IsZero() {
+		expiry = info.TokenExpiry.Local().Format(time.RFC1123)
+	}
+	fmt.Printf("User:         %v\n", info.UserName)
+	fmt.Printf("User ID:      %v\n", info.UserID)
+	fmt.Printf("Server:       %v\n", info.ServerURL)
+	fmt.Printf("Token expiry: %v\n", expiry)
+	return nil
+}
+
+// refreshToken saves a new token using the current token, authenticating
+// with a password if the current token is missing or expired
+func refreshToken(args Args) error {
+	config, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	api := userapi.New(config)
+	api.SetLogger(logger)
+	if api.TokenExpired() {
+		logger.Debugf("token for %v is missing or expired", api.User())
+		err = authenticateUser(api, config)
+	} else {
+		err = api.SaveTemporaryToken(config.TokenTTL)
+		if userapi.IsAuthenticationError(err) {
+			err = authenticateUser(api, config)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("Refreshed the token for %v on %v", api.User(), api.ServerURL())
+	return nil
+}
+
+// forceUnlock removes lock files that no csalt holds, lock files that are held
+// are reported and left in place
+func forceUnlock(args Args) error {
+	var extraFiles []string
+	if args.AuditLog != "" {
+		extraFiles = append(extraFiles, args.AuditLog)
+	} else if config, err := userapi.NewConfig(); err == nil && config.AuditLog != "" {
+		// the config is only read for its audit log, locks are checked without it
+		extraFiles = append(extraFiles, config.AuditLog)
+	}
+	stale, held, err := userapi.StaleLocks(extraFiles...)
+	for _, lockFile := range stale {
+		logger.Infof("%v isn't held, it was left by a csalt that exited and doesn't block csalt", lockFile)
+	}
+	if err != nil {
+		return err
+	}
+	if len(held) > 0 {
+		return fmt.Errorf("%v held by another csalt, wait for it to finish", strings.Join(held, ", "))
+	}
+	logger.Infof("No locks are held")
+	return nil
+}
+
+// loginAndExit authenticates with a password and saves a new token, printing
+// when the token expires
+func loginAndExit(args Args) error {
+	if os.Getenv(userapi.TokenEnv) != "" {
+		return fmt.Errorf("--login saves a token so can't be used with %v set", userapi.TokenEnv)
+	}
+	config, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	api := userapi.New(config)
+	api.SetLogger(logger)
+	api.ClearToken()
+	if err := login(api, config); err != nil {
+		return err
+	}
+	// use the saved token rather than the one used to save it
+	api.ReloadToken()
+	expiry, err := api.TokenExpiry()
+	if err != nil || expiry.IsZero() {
+		logger.Infof("Logged in as %v on %v", api.User(), api.ServerURL())
+		return nil
+	}
+	logger.Infof("Logged in as %v on %v, the token expires at %v", api.User(), api.ServerURL(), expiry.Local().Format(time.RFC1123))
+	return nil
+}
+
+// checkQueryAndCommand returns an error if it isn't clear that query is a
+// device query for command, a query that is only groups that look like salt
+// functions is more likely to be a salt command with arguments
+func checkQueryAndCommand(query resolver.DeviceQuery, command []string) error {
+	if !query.HasValues() {
+		return fmt.Errorf("a device query is required before the command %q, run salt directly to target all minions", strings.Join(command, " "))
+	}
+	if strings.ContainsAny(query.RawArg, ":#") {
+		// devices, salt ids and groups written as group: are unambiguous
+		return nil
+	}
+	for _, group := range query.Groups {
+		if !saltFunction.MatchString(group) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q looks like a salt command rather than a group, use %q to query it as a group", query.RawArg, query.Groups[0]+":")
+}
+
+// runWithoutCommand handles a single positional argument. A single group
+// written as group: lists the group's devices, another single word is run
+// directly on salt as it could be a salt command, otherwise it is a device
+// query that is missing its command
+func runWithoutCommand(args Args) error {
+	query := args.DeviceInfo
+	if !query.HasValues() {
+		return resolver.ErrNoCommand
+	}
+	if isSingleGroup(query) {
+		if err := printDeviceNames(args); err != nil {
 			return err
 		}
-		devices, err = api.TranslateNames(args.DeviceInfo.groups, args.DeviceInfo.devices)
+		logger.Infof("No salt command given for %q, add one to run it on these devices e.g. csalt %q test.ping", query.RawArg, query.RawArg)
+		return nil
+	}
+	if len(query.Groups) == 1 && len(query.Devices) == 0 && len(query.SaltIDs) == 0 {
+		return runSalt(args, strings.TrimSpace(query.RawArg))
+	}
+	logger.Infof("No salt command given for %q, add one e.g. csalt %q test.ping or use --groups-only to see the devices", query.RawArg, query.RawArg)
+	return resolver.ErrNoCommand
+}
+
+// isSingleGroup returns true if query is a single group written as group:,
+// which can't be mistaken for a salt command
+func isSingleGroup(query resolver.DeviceQuery) bool {
+	return len(query.Groups) == 1 && len(query.Devices) == 0 && len(query.SaltIDs) == 0 &&
+		strings.Contains(query.RawArg, ":")
+}
 
+// groupCommand returns the command configured in group-commands for a query
+// that is a single group written as group:, or nil if there isn't one
+func groupCommand(args Args) ([]string, error) {
+	query := args.DeviceInfo
+	if !isSingleGroup(query) {
+		return nil, nil
 	}
+	config, err := loadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	// group names are matched ignoring case like the server does, preferring
+	// a group written the same way
+	group := query.Groups[0]
+	command, ok := config.GroupCommands[group]
+	if !ok {
+		for name, groupCommand := range config.GroupCommands {
+			if strings.EqualFold(name, group) {
+				command = groupCommand
+				break
+			}
+		}
+	}
+	if command != nil {
+		logger.Debugf("running the group-commands command for %v", group)
+	}
+	return command, nil
+}
 
+// runLast runs the command on the devices the last query resolved to, all
+// positional arguments are part of the command
+func runLast(args Args, result *runResult) error {
+	last, err := userapi.ReadLastQuery()
+	if err != nil {
+		return err
+	}
+	if args.DeviceInfo.RawArg != "" {
+		args.Commands = append([]string{args.DeviceInfo.RawArg}, args.Commands...)
+	}
+	if len(args.Commands) == 0 {
+		return resolver.ErrNoCommand
+	}
+	r, config, err := newResolver(args, false)
 	if err != nil {
 		return err
 	}
+	if last.ServerURL != config.ServerURL {
+		return fmt.Errorf("the last query %q was run on %v not %v", last.Query, last.ServerURL, config.ServerURL)
+	}
+	logger.Infof("Using devices from %q at %v", last.Query, last.Time.Local().Format(time.RFC1123))
+	return runSaltForDevices(r, config, last.Devices, args, result)
+}
+
+// saveLastQuery is userapi.SaveLastQuery, it can be replaced to run without
+// saving to the users home directory
+var saveLastQuery = userapi.SaveLastQuery
+
+// logField adds a field to the following log messages when logging json
+func logField(key string, value interface{}) {
+	if jsonLogger, ok := logger.(*userapi.JSONLogger); ok {
+		jsonLogger.SetField(key, value)
+	}
+}
+
+// runMain parses the arguments and runs csalt, returning what was run
+func runMain() (*runResult, error) {
+	args := procArgs()
+	if args.LogFormat == jsonLogFormat {
+		jsonLogger := userapi.NewJSONLogger(os.Stderr, args.Verbose)
+		jsonLogger.Quiet = args.Quiet
+		logger = jsonLogger
+	} else {
+		stdLogger := userapi.NewStdLogger(os.Stderr, os.Stderr, args.Verbose)
+		stdLogger.Quiet = args.Quiet
+		stdLogger.Color = !args.NoColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stderr)
+		logger = stdLogger
+	}
+
+	start := time.Now()
+	result := &runResult{}
+	err := run(args, result)
+	result.Duration = time.Since(start)
+	result.ExitCode = exitCode(err)
+	return result, err
+}
+
+// stdinQuery is the device query argument that reads the query from stdin
+const stdinQuery = "-"
 
-	return runSaltForDevices(api.ServerURL(), devices, args.Commands)
+// readQuery reads a whitespace or newline separated device query from in
+func readQuery(in io.Reader) (resolver.DeviceQuery, error) {
+	var query resolver.DeviceQuery
+	buf, err := ioutil.ReadAll(in)
+	if err != nil {
+		return query, fmt.Errorf("could not read device query: %v", err)
+	}
+	if err := query.UnmarshalText(buf); err != nil {
+		return query, err
+	}
+	if !query.HasValues() {
+		return query, errors.New("no devices were read from stdin")
+	}
+	return query, nil
+}
+
+// flagQuery returns the device query from the --group and --device flags
+func flagQuery(groups, devices []string) (resolver.DeviceQuery, error) {
+	query := resolver.DeviceQuery{Groups: groups}
+	for _, device := range devices {
+		pos := strings.Index(device, ":")
+		if pos <= 0 || pos == len(device)-1 {
+			return query, fmt.Errorf("--device %v must be in the format <groupname>:<devicename>", device)
+		}
+		query.Devices = append(query.Devices, userapi.Device{
+			GroupName:  device[:pos],
+			DeviceName: device[pos+1:],
+		})
+	}
+	// groups are written as <groupname>: so they aren't mistaken for commands
+	var raw []string
+	for _, group := range groups {
+		raw = append(raw, group+":")
+	}
+	query.RawArg = strings.Join(append(raw, devices...), " ")
+	return query, nil
+}
+
+// run does what args asks for, recording the devices salt is run on in result
+func run(args Args, result *runResult) error {
+	if len(args.Group) > 0 || len(args.Device) > 0 {
+		if args.DeviceInfo.RawArg != "" {
+			args.Commands = append([]string{args.DeviceInfo.RawArg}, args.Commands...)
+		}
+		query, err := flagQuery(args.Group, args.Device)
+		if err != nil {
+			return err
+		}
+		args.DeviceInfo = query
+	} else if strings.TrimSpace(args.DeviceInfo.RawArg) == stdinQuery {
+		query, err := readQuery(os.Stdin)
+		if err != nil {
+			return err
+		}
+		args.DeviceInfo = query
+	}
+	if args.Completion != "" {
+		script, err := completionScript(args.Completion)
+		if err != nil {
+			return err
+		}
+		fmt.Print(script)
+		return nil
+	}
+	if args.CompleteDevices {
+		printCompletionDevices(args)
+		return nil
+	}
+	if args.Check {
+		return checkConnection(args)
+	}
+	if args.Doctor {
+		return doctor(args)
+	}
+	if args.ForceUnlock {
+		return forceUnlock(args)
+	}
+	if args.Whoami {
+		return whoami(args)
+	}
+	if args.RefreshToken {
+		return refreshToken(args)
+	}
+	if args.Login {
+		return loginAndExit(args)
+	}
+	if args.Relogin && !args.DeviceInfo.HasValues() && len(args.Commands) == 0 && !args.List {
+		_, api, err := connectAPI(args)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Logged in as %v on %v", api.User(), api.ServerURL())
+		return nil
+	}
+	if args.List {
+		return listDevices(args)
+	}
+	if args.GroupsOnly {
+		return printDeviceNames(args)
+	}
+	if args.Count {
+		return countDevices(args)
+	}
+	if args.AsNodegroup != "" {
+		return printNodegroup(args)
+	}
+	if err := checkSalt(args.SaltPath); err != nil {
+		return err
+	}
+	if args.OutputFile != "" {
+		f, err := os.OpenFile(args.OutputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open output file: %v", err)
+		}
+		defer f.Close()
+		args.outputFile = f
+	}
+	if args.FromFile != "" {
+		return runBatch(args, result)
+	}
+	if args.Compound {
+		return runCompound(args)
+	}
+	if args.Last {
+		return runLast(args, result)
+	}
+	if len(args.Commands) == 0 {
+		command, err := groupCommand(args)
+		if err != nil {
+			return err
+		}
+		if command == nil {
+			return runWithoutCommand(args)
+		}
+		args.Commands = command
+	}
+	if err := checkQueryAndCommand(args.DeviceInfo, args.Commands); err != nil {
+		return err
+	}
+	r, config, devices, err := resolveDevices(args)
+	if err != nil {
+		return err
+	}
+	if err := runSaltForDevices(r, config, devices, args, result); err != nil {
+		return err
+	}
+	// the devices salt was run on are saved, after excluding and filtering
+	err = saveLastQuery(args.DeviceInfo.RawArg, config.ServerURL, result.Devices)
+	if err != nil {
+		logger.Warnf("Error saving last query %v", err)
+	}
+	return nil
 }
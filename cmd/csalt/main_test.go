@@ -0,0 +1,1354 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/csalt/resolver"
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// fakeSalt records its arguments in $FAKE_SALT_CALLS, one line per run, and
+// exits with $FAKE_SALT_EXIT
+const fakeSalt = `#!/bin/sh
+printf '[%s]' "$@" >> "$FAKE_SALT_CALLS"
+echo >> "$FAKE_SALT_CALLS"
+echo "out: $*"
+echo "err: $*" >&2
+exit ${FAKE_SALT_EXIT:-0}
+`
+
+const testServer = "https://api.example.com"
+
+// fakeAPI is an authenticated API with a fixed list of devices
+type fakeAPI struct {
+	userapi.API
+	devices  []userapi.Device
+	messages []string
+	calls    int
+	// passwords are the passwords Authenticate was called with
+	passwords []string
+	authErr   error
+	// versionErr is returned by CheckServerVersion
+	versionErr error
+}
+
+func (f *fakeAPI) ServerURL() string {
+	return testServer
+}
+
+func (f *fakeAPI) User() string {
+	return "user"
+}
+
+func (f *fakeAPI) NeedsAuthentication() bool {
+	return false
+}
+
+func (f *fakeAPI) Messages() []string {
+	return f.messages
+}
+
+func (f *fakeAPI) CheckServerVersion() error {
+	return f.versionErr
+}
+
+// Authenticate records the password, failing with authErr
+func (f *fakeAPI) Authenticate(password string) error {
+	f.passwords = append(f.passwords, password)
+	return f.authErr
+}
+
+func (f *fakeAPI) TranslateNamesContext(ctx context.Context, groups []string, devices []userapi.Device) ([]userapi.Device, error) {
+	f.calls++
+	devQ := &resolver.DeviceQuery{Groups: groups, Devices: devices}
+	var matched []userapi.Device
+	for _, device := range f.devices {
+		if len(groups) == 0 && len(devices) == 0 || devQ.Matches(device) {
+			matched = append(matched, device)
+		}
+	}
+	return matched, nil
+}
+
+var testDevices = []userapi.Device{
+	{GroupName: "grp1", DeviceName: "dev1", SaltId: 1},
+	{GroupName: "grp1", DeviceName: "dev2", SaltId: 2},
+	{GroupName: "grp2", DeviceName: "dev3", SaltId: 3},
+}
+
+func TestMain(m *testing.M) {
+	logger = userapi.NewStdLogger(ioutil.Discard, ioutil.Discard, false)
+	for _, env := range []string{userapi.TokenEnv, passwordEnv, "FAKE_SALT_EXIT", "NO_COLOR"} {
+		os.Unsetenv(env)
+	}
+	os.Exit(m.Run())
+}
+
+// testEnv runs csalt with a config in a temporary XDG_CONFIG_HOME, a fake API
+// and a fake salt that is run without sudo
+type testEnv struct {
+	dir  string
+	api  *fakeAPI
+	salt string
+	// stdin is what csalt reads from stdin
+	stdin string
+	// lastQuery and lastDevices are what would have been saved as the last
+	// query
+	lastQuery   string
+	lastDevices []userapi.Device
+}
+
+func newTestEnv(t *testing.T) (*testEnv, func()) {
+	dir, err := ioutil.TempDir("", "csalt-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &testEnv{
+		dir:  dir,
+		api:  &fakeAPI{devices: testDevices},
+		salt: path.Join(dir, "salt"),
+	}
+	env.writeConfig(t, testServer)
+	writeFile(t, env.salt, fakeSalt, 0700)
+
+	restoreEnv := []func(){
+		setEnv("XDG_CONFIG_HOME", dir),
+		setEnv(userapi.TokenEnv, "test-token"),
+		setEnv("FAKE_SALT_CALLS", path.Join(dir, "calls")),
+	}
+	previousAPI, previousLookPath, previousExec, previousSave := newAPI, lookPath, execCommand, saveLastQuery
+	newAPI = func(args Args, config *userapi.Config) userapi.API {
+		return env.api
+	}
+	lookPath = func(file string) (string, error) {
+		return file, nil
+	}
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		// name is sudo, which the fake salt is run without
+		return exec.Command(arg[0], arg[1:]...)
+	}
+	saveLastQuery = func(query, serverURL string, devices []userapi.Device) error {
+		env.lastQuery = query
+		env.lastDevices = devices
+		return nil
+	}
+	return env, func() {
+		newAPI, lookPath, execCommand, saveLastQuery = previousAPI, previousLookPath, previousExec, previousSave
+		for _, restore := range restoreEnv {
+			restore()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// writeConfig writes the csalt config for serverURL, with the audit log in
+// the test directory
+func (env *testEnv) writeConfig(t *testing.T, serverURL string) {
+	config := fmt.Sprintf("server-url: %v\nuser-name: user\naudit-log: %v\n", serverURL, env.auditLog())
+	writeFile(t, path.Join(env.dir, "csalt", "cacophony-user.yaml"), config, 0600)
+}
+
+func (env *testEnv) auditLog() string {
+	return path.Join(env.dir, "audit.log")
+}
+
+// saltCalls returns the arguments of each salt run
+func (env *testEnv) saltCalls(t *testing.T) []string {
+	buf, err := ioutil.ReadFile(os.Getenv("FAKE_SALT_CALLS"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+}
+
+// run runs csalt with args, returning what was written to stdout and stderr
+func (env *testEnv) run(t *testing.T, args ...string) (stdout, stderr string, result *runResult, err error) {
+	stdinPath := path.Join(env.dir, "stdin")
+	writeFile(t, stdinPath, env.stdin, 0600)
+	stdinFile, err := os.Open(stdinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinFile.Close()
+	outputFiles := make([]*os.File, 2)
+	for i, name := range []string{"stdout", "stderr"} {
+		f, err := os.Create(path.Join(env.dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		outputFiles[i] = f
+	}
+
+	previousArgs, previousLogger := os.Args, logger
+	previousStdin, previousStdout, previousStderr := os.Stdin, os.Stdout, os.Stderr
+	os.Args = append([]string{"csalt", "--salt-path", env.salt}, args...)
+	os.Stdin, os.Stdout, os.Stderr = stdinFile, outputFiles[0], outputFiles[1]
+	result, err = runMain()
+	os.Args, logger = previousArgs, previousLogger
+	os.Stdin, os.Stdout, os.Stderr = previousStdin, previousStdout, previousStderr
+
+	output := make([]string, 2)
+	for i, f := range outputFiles {
+		buf, readErr := ioutil.ReadFile(f.Name())
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		output[i] = string(buf)
+	}
+	return output[0], output[1], result, err
+}
+
+// setEnv sets the environment variable name, the returned func restores its
+// previous value
+func setEnv(name, value string) func() {
+	previous, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// writeFile writes content to filename, creating its directory
+func writeFile(t *testing.T, filename, content string, mode os.FileMode) {
+	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filename, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, _, _, err := env.run(t, "--list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "grp1\n  dev1\n  dev2\ngrp2\n  dev3\n"; stdout != want {
+		t.Errorf("--list printed %q, want %q", stdout, want)
+	}
+}
+
+func TestListDevicesWithoutAccess(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.devices = nil
+	stdout, stderr, result, err := env.run(t, "--list")
+	if err != nil || result.ExitCode != 0 {
+		t.Fatalf("--list without devices = %d, %v", result.ExitCode, err)
+	}
+	if stdout != "" || stderr != "user does not have access to any devices\n" {
+		t.Errorf("--list without devices printed %q to stdout and %q to stderr", stdout, stderr)
+	}
+}
+
+func TestRunMainSaltIDs(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	_, _, result, err := env.run(t, "#5 saltid:6", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []userapi.Device{{SaltId: 5}, {SaltId: 6}}; !reflect.DeepEqual(result.Devices, want) {
+		t.Errorf("ran on %v, want %v", result.Devices, want)
+	}
+	if calls := env.saltCalls(t); len(calls) != 1 || !strings.Contains(calls[0], "pi-5 pi-6") {
+		t.Errorf("salt was run with %q", calls)
+	}
+	if env.api.calls != 0 {
+		t.Errorf("the API was called %d times to run on salt ids", env.api.calls)
+	}
+}
+
+func TestRunMainCompound(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "-C", "G@os:Raspbian and #7", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-C][G@os:Raspbian and pi-7][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestCompoundSaltArgs(t *testing.T) {
+	args := compoundSaltArgs("pi", "G@os:Raspbian and #12 or #3", []string{"test.ping"})
+	want := []string{"-C", "G@os:Raspbian and pi-12 or pi-3", "test.ping"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("compoundSaltArgs() = %q, want %q", args, want)
+	}
+	args = compoundSaltArgs("", "#12", []string{"test.ping"})
+	if want := []string{"-C", "12", "test.ping"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("compoundSaltArgs() without a prefix = %q, want %q", args, want)
+	}
+}
+
+func TestConfirmDevices(t *testing.T) {
+	tests := []struct {
+		input       string
+		interactive bool
+		count       int
+		ok          bool
+	}{
+		{"", false, confirmThreshold, true},
+		{"", false, confirmThreshold + 1, false},
+		{"yes\n", true, 10, true},
+		{" yes ", true, 10, true},
+		{"no\n", true, 10, false},
+		{"", true, 10, false},
+	}
+	defer swapStderr(t)()
+	for _, test := range tests {
+		err := confirmDevices(strings.NewReader(test.input), test.interactive, test.count)
+		if (err == nil) != test.ok {
+			t.Errorf("confirmDevices(%q, %v, %d) = %v", test.input, test.interactive, test.count, err)
+		}
+	}
+}
+
+// swapStderr discards what is written to os.Stderr, the returned func
+// restores it
+func swapStderr(t *testing.T) func() {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stderr
+	os.Stderr = devNull
+	return func() {
+		os.Stderr = previous
+		devNull.Close()
+	}
+}
+
+func TestRunMainConfirm(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	for i := 4; i <= confirmThreshold+2; i++ {
+		env.api.devices = append(env.api.devices, userapi.Device{GroupName: "grp1", DeviceName: fmt.Sprintf("dev%d", i), SaltId: i})
+	}
+	if _, _, _, err := env.run(t, "grp1", "cmd.run", "reboot"); err == nil || !strings.Contains(err.Error(), "without confirmation") {
+		t.Errorf("runMain() on more than %d devices without --yes = %v", confirmThreshold, err)
+	}
+	if calls := env.saltCalls(t); len(calls) > 0 {
+		t.Fatalf("salt was run with %q without confirmation", calls)
+	}
+	if _, _, _, err := env.run(t, "--yes", "grp1", "cmd.run", "reboot"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := env.saltCalls(t); len(calls) != 1 {
+		t.Errorf("salt was run with %q after --yes", calls)
+	}
+}
+
+func TestRunMainSaltArgs(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	_, stderr, _, err := env.run(t, "--show-command", "grp1", "cmd.run", "echo hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-1 pi-2][cmd.run][echo hi]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+	command := fmt.Sprintf(`sudo %v -L 'pi-1 pi-2' cmd.run 'echo hi'`, env.salt)
+	if !strings.Contains(stderr, command) {
+		t.Errorf("stderr %q doesn't show the command %q", stderr, command)
+	}
+}
+
+func TestRunMainSaltFails(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	defer setEnv("FAKE_SALT_EXIT", "3")()
+	_, _, result, err := env.run(t, "grp1:dev1", "test.ping")
+	if _, ok := err.(*exec.ExitError); !ok || result.ExitCode != 3 {
+		t.Errorf("runMain() with salt failing = %+v, %v", result, err)
+	}
+	if env.lastQuery != "" {
+		t.Errorf("last query %q was saved after salt failed", env.lastQuery)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 4").Run()
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{exitErr, 4},
+		{resolver.ErrNoCommand, noCommandErrorCode},
+		{fmt.Errorf("wrapped: %w", resolver.ErrNoDevices), noDevicesErrorCode},
+		{errors.New("other"), internalErrorCode},
+	}
+	for _, test := range tests {
+		if code := exitCode(test.err); code != test.want {
+			t.Errorf("exitCode(%v) = %d, want %d", test.err, code, test.want)
+		}
+	}
+}
+
+func TestSaltOptions(t *testing.T) {
+	tests := []struct {
+		args Args
+		want []string
+	}{
+		{Args{}, nil},
+		{Args{Async: true}, []string{"--async"}},
+		{Args{BatchSize: 10}, []string{"-b", "10"}},
+		{Args{Async: true, BatchSize: 10}, []string{"--async", "-b", "10"}},
+		{Args{SaltTimeout: 30}, []string{"-t", "30"}},
+		{Args{BatchSize: 10, SaltTimeout: 30}, []string{"-b", "10", "-t", "30"}},
+	}
+	for _, test := range tests {
+		if options := saltOptions(test.args); !reflect.DeepEqual(options, test.want) {
+			t.Errorf("saltOptions(%+v) = %q, want %q", test.args, options, test.want)
+		}
+	}
+}
+
+func TestRunMainSaltOptions(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "--async", "-b", "2", "#5", "cmd.run", "echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[--async][-b][2][-L][pi-5][cmd.run][echo hi]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestRunMainCompletion(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, _, _, err := env.run(t, "--completion", "bash")
+	if err != nil || !strings.Contains(stdout, "complete -F _csalt csalt") {
+		t.Errorf("--completion bash = %q, %v", stdout, err)
+	}
+	if _, _, _, err := env.run(t, "--completion", "fish"); err == nil {
+		t.Error("--completion for an unsupported shell succeeded")
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	if name := deviceName(testDevices[0]); name != "grp1:dev1" {
+		t.Errorf("deviceName() = %v", name)
+	}
+	if name := deviceName(userapi.Device{SaltId: 5}); name != "#5" {
+		t.Errorf("deviceName() of a salt id = %v", name)
+	}
+}
+
+func TestRunMainSharedSaltID(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.devices = append(env.api.devices, userapi.Device{GroupName: "grp3", DeviceName: "dev4", SaltId: 1})
+	_, stderr, result, err := env.run(t, "grp1:dev1 grp3", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "#1 is used by grp1:dev1 and grp3:dev4") {
+		t.Errorf("stderr %q doesn't warn about the shared salt id", stderr)
+	}
+	want := []string{`[-L][pi-1][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+	if len(result.Devices) != 1 || !strings.Contains(stderr, "on 1 devices") {
+		t.Errorf("ran on %v, stderr %q", result.Devices, stderr)
+	}
+
+	stdout, _, _, err := env.run(t, "--count", "grp1:dev1 grp3")
+	if err != nil || stdout != "1\n" {
+		t.Errorf("--count of devices sharing a salt id = %q, %v", stdout, err)
+	}
+}
+
+// authenticationError returns the error a real API returns when it has no
+// token
+func authenticationError(t *testing.T) error {
+	api := userapi.New(&userapi.Config{ServerURL: "https://localhost", UserName: "user"})
+	api.SetCacheMode(userapi.CacheDisabled)
+	_, err := api.TranslateNames([]string{"grp"}, nil)
+	if !userapi.IsAuthenticationError(err) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+	return err
+}
+
+func TestRequestAuthenticationAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csalt-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, path.Join(dir, "stdin"), "one\ntwo\nthree\nfour\n", 0600)
+	stdin, err := os.Open(path.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	previousStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = previousStdin }()
+	defer swapStderr(t)()
+
+	api := &fakeAPI{authErr: authenticationError(t)}
+	if err := requestAuthentication(api, 3); err == nil || err.Error() != "Max Password Attempts" {
+		t.Errorf("requestAuthentication() with the wrong password = %v", err)
+	}
+	if want := []string{"one", "two", "three"}; !reflect.DeepEqual(api.passwords, want) {
+		t.Errorf("authenticated with %q, want %q", api.passwords, want)
+	}
+
+	defer setEnv(passwordEnv, "secret")()
+	api = &fakeAPI{authErr: authenticationError(t)}
+	if err := requestAuthentication(api, 3); !userapi.IsAuthenticationError(err) {
+		t.Errorf("requestAuthentication() with %v = %v", passwordEnv, err)
+	}
+	if want := []string{"secret"}; !reflect.DeepEqual(api.passwords, want) {
+		t.Errorf("authenticated with %q using %v, want %q", api.passwords, passwordEnv, want)
+	}
+}
+
+func TestChunkDevices(t *testing.T) {
+	devices := []userapi.Device{{SaltId: 1}, {SaltId: 2}, {SaltId: 3}}
+	tests := []struct {
+		size int
+		want [][]userapi.Device
+	}{
+		{0, [][]userapi.Device{devices}},
+		{3, [][]userapi.Device{devices}},
+		{2, [][]userapi.Device{devices[:2], devices[2:]}},
+		{1, [][]userapi.Device{devices[:1], devices[1:2], devices[2:]}},
+	}
+	for _, test := range tests {
+		if chunks := chunkDevices(devices, test.size); !reflect.DeepEqual(chunks, test.want) {
+			t.Errorf("chunkDevices(%d) = %v, want %v", test.size, chunks, test.want)
+		}
+	}
+}
+
+func TestRunMainChunks(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "--chunk-size", "2", "grp1 grp2", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-1 pi-2][test.ping]`, `[-L][pi-3][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestRunMainCapture(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	defer setEnv("FAKE_SALT_EXIT", "2")()
+	stdout, _, result, _ := env.run(t, "--capture", "#5", "test.ping")
+	var output saltOutput
+	if err := json.Unmarshal([]byte(stdout), &output); err != nil {
+		t.Fatalf("invalid json %q: %v", stdout, err)
+	}
+	want := saltOutput{Stdout: "out: -L pi-5 test.ping\n", Stderr: "err: -L pi-5 test.ping\n", ExitCode: 2}
+	if output != want {
+		t.Errorf("captured %+v, want %+v", output, want)
+	}
+	if result.ExitCode != 2 {
+		t.Errorf("exit code = %d", result.ExitCode)
+	}
+}
+
+// testJWT returns a JWT token that expires at expiry
+func testJWT(expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, expiry.Unix())))
+	return "JWT header." + payload + ".signature"
+}
+
+// tokenServer is an API server that logs in with the password "secret",
+// returning token, and saves a new token for requests authenticated with
+// token
+type tokenServer struct {
+	*httptest.Server
+	token  string
+	logins int
+	saves  int
+}
+
+func newTokenServer(token string) *tokenServer {
+	s := &tokenServer{token: token}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/authenticate_user":
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["password"] != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			s.logins++
+			json.NewEncoder(w).Encode(map[string]interface{}{"token": s.token, "id": 1})
+		case "/token":
+			if r.Header.Get("Authorization") != s.token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			s.saves++
+			json.NewEncoder(w).Encode(map[string]interface{}{"token": "saved-token"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+// writeToken saves token as the token for the test user on serverURL
+func (env *testEnv) writeToken(t *testing.T, serverURL, token string) {
+	tokens := fmt.Sprintf("tokens:\n- server-url: %v\n  user-name: user\n  token: %v\n", serverURL, token)
+	writeFile(t, path.Join(env.dir, "csalt", "cacophony-token"), tokens, 0600)
+}
+
+// savedToken returns the token saved in the token file
+func (env *testEnv) savedToken(t *testing.T) string {
+	buf, err := ioutil.ReadFile(path.Join(env.dir, "csalt", "cacophony-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestRefreshToken(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	defer setEnv(userapi.TokenEnv, "")()
+	server := newTokenServer(testJWT(time.Now().Add(time.Hour)))
+	defer server.Close()
+	env.writeConfig(t, server.URL)
+
+	env.writeToken(t, server.URL, server.token)
+	if _, _, _, err := env.run(t, "--refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+	if server.logins != 0 || server.saves != 1 || !strings.Contains(env.savedToken(t), "saved-token") {
+		t.Errorf("refreshing a valid token logged in %d times and saved %d tokens: %q", server.logins, server.saves, env.savedToken(t))
+	}
+
+	// an expired token is replaced by logging in with a password
+	defer setEnv(passwordEnv, "secret")()
+	env.writeToken(t, server.URL, testJWT(time.Now().Add(-time.Hour)))
+	if _, _, _, err := env.run(t, "--refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+	if server.logins != 1 || server.saves != 2 || !strings.Contains(env.savedToken(t), "saved-token") {
+		t.Errorf("refreshing an expired token logged in %d times and saved %d tokens: %q", server.logins, server.saves, env.savedToken(t))
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	defer setEnv(userapi.TokenEnv, "")()
+	defer setEnv(passwordEnv, "secret")()
+	server := newTokenServer(testJWT(time.Now().Add(time.Hour)))
+	defer server.Close()
+	env.writeConfig(t, server.URL)
+	newAPI = func(args Args, config *userapi.Config) userapi.API {
+		return userapi.New(config)
+	}
+
+	// the saved token is valid, but a password is still asked for
+	env.writeToken(t, server.URL, server.token)
+	if _, _, _, err := env.run(t, "--relogin"); err != nil {
+		t.Fatal(err)
+	}
+	if server.logins != 1 || server.saves != 1 || !strings.Contains(env.savedToken(t), "saved-token") {
+		t.Errorf("--relogin with a valid token logged in %d times and saved %d tokens: %q", server.logins, server.saves, env.savedToken(t))
+	}
+}
+
+func TestOnlineDevices(t *testing.T) {
+	recent := time.Now().Add(-time.Minute)
+	old := time.Now().Add(-2 * userapi.OfflineAfter)
+	devices := []userapi.Device{{SaltId: 1}, {SaltId: 2, LastSeen: &recent}, {SaltId: 3, LastSeen: &old}}
+	if online := onlineDevices(devices); !reflect.DeepEqual(online, devices[:2]) {
+		t.Errorf("onlineDevices() = %v", online)
+	}
+}
+
+func TestRunMainWithoutCommand(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, _, _, err := env.run(t, "grp1:")
+	if err != nil || stdout != "grp1:dev1\ngrp1:dev2\n" {
+		t.Errorf("runMain() of a single group = %q, %v", stdout, err)
+	}
+	if calls := env.saltCalls(t); len(calls) > 0 {
+		t.Errorf("salt was run with %q for a group without a command", calls)
+	}
+
+	if _, _, _, err := env.run(t, "test.version"); err != nil {
+		t.Fatal(err)
+	}
+	if calls, want := env.saltCalls(t), []string{"[test.version]"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestCheckQueryAndCommand(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"grp1", true},
+		{"test.ping", false},
+		{"test.ping grains.items", false},
+		{"test.ping:", true},
+		{"test.ping grp1", true},
+		{"#5", true},
+		{"", false},
+	}
+	for _, test := range tests {
+		query, err := resolver.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkQueryAndCommand(*query, []string{"test.version"}); (err == nil) != test.ok {
+			t.Errorf("checkQueryAndCommand(%q) = %v", test.query, err)
+		}
+	}
+}
+
+func TestIsSingleGroup(t *testing.T) {
+	tests := map[string]bool{
+		"grp1:":      true,
+		"grp1":       false,
+		"grp1: grp2": false,
+		"grp1:dev1":  false,
+	}
+	for raw, want := range tests {
+		query, err := resolver.ParseQuery(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if single := isSingleGroup(*query); single != want {
+			t.Errorf("isSingleGroup(%q) = %v", raw, single)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if tmpl, err := parseFormat(""); tmpl != nil || err != nil {
+		t.Errorf("parseFormat() of no format = %v, %v", tmpl, err)
+	}
+	if _, err := parseFormat("{{.SaltId"); err == nil || !strings.Contains(err.Error(), "invalid --format") {
+		t.Errorf("parseFormat() of an invalid template error = %v", err)
+	}
+}
+
+func TestListDevicesFormat(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, _, _, err := env.run(t, "--list", "--format", "{{.DeviceName}} #{{.SaltId}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "dev1 #1\ndev2 #2\ndev3 #3\n"; stdout != want {
+		t.Errorf("--list --format printed %q, want %q", stdout, want)
+	}
+}
+
+func TestRunMainServerMessages(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.messages = []string{"grp9 not found"}
+	_, stderr, _, err := env.run(t, "grp1 grp9", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "Server: grp9 not found") {
+		t.Errorf("stderr %q doesn't include the server's message", stderr)
+	}
+}
+
+func TestRunMainServerVersion(t *testing.T) {
+	tests := []struct {
+		versionErr error
+		warning    bool
+	}{
+		{nil, false},
+		{userapi.ErrServerVersionUnknown, false},
+		{fmt.Errorf("%w: 9.0.0", userapi.ErrUnsupportedVersion), true},
+	}
+	for _, test := range tests {
+		env, cleanup := newTestEnv(t)
+		env.api.versionErr = test.versionErr
+		_, stderr, _, err := env.run(t, "grp1", "test.ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(stderr, "not supported"); warned != test.warning {
+			t.Errorf("version error %v warned %v, stderr %q", test.versionErr, warned, stderr)
+		}
+		cleanup()
+	}
+}
+
+func TestRunMainErrors(t *testing.T) {
+	tests := []struct {
+		args     []string
+		exitCode int
+		err      error
+		// message is part of the error when there isn't an error to match
+		message string
+	}{
+		{[]string{"missing", "test.ping"}, noDevicesErrorCode, resolver.ErrNoDevices, ""},
+		{[]string{"grp1 grp2"}, noCommandErrorCode, resolver.ErrNoCommand, ""},
+		{[]string{"test.ping", "test.version"}, internalErrorCode, nil, "looks like a salt command"},
+		{[]string{"--group", "grp1", "--device", "dev1", "test.ping"}, internalErrorCode, nil, "must be in the format"},
+		{[]string{"--filter", "^x", "grp1", "test.ping"}, noDevicesErrorCode, resolver.ErrNoDevices, ""},
+	}
+	for _, test := range tests {
+		env, cleanup := newTestEnv(t)
+		_, _, result, err := env.run(t, test.args...)
+		if err == nil || test.err != nil && !errors.Is(err, test.err) ||
+			!strings.Contains(err.Error(), test.message) || result.ExitCode != test.exitCode {
+			t.Errorf("runMain(%q) = %d, %v", test.args, result.ExitCode, err)
+		}
+		if calls := env.saltCalls(t); len(calls) > 0 {
+			t.Errorf("runMain(%q) ran salt with %q", test.args, calls)
+		}
+		cleanup()
+	}
+}
+
+// versionTestEnv is set when TestVersion runs itself, go-arg exits after
+// printing the version so it is run in a separate process
+const versionTestEnv = "CSALT_TEST_VERSION"
+
+func TestVersion(t *testing.T) {
+	if os.Getenv(versionTestEnv) != "" {
+		newAPI = func(args Args, config *userapi.Config) userapi.API {
+			fmt.Fprintln(os.Stderr, "the API was created")
+			os.Exit(3)
+			return nil
+		}
+		os.Args = []string{"csalt", "--version", "grp1", "test.ping"}
+		runMain()
+		fmt.Fprintln(os.Stderr, "--version didn't exit")
+		os.Exit(4)
+	}
+
+	dir, err := ioutil.TempDir("", "csalt-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// there is no config, so reading it would prompt for one
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersion$")
+	cmd.Env = append(os.Environ(), versionTestEnv+"=1", "XDG_CONFIG_HOME="+dir)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("--version failed: %v %q", err, stderr.String())
+	}
+	if !strings.HasPrefix(string(stdout), "csalt dev (commit unknown") {
+		t.Errorf("--version printed %q", stdout)
+	}
+}
+
+func TestRunMainSaltMissing(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	lookPath = func(file string) (string, error) {
+		if file == "sudo" {
+			return file, nil
+		}
+		return "", exec.ErrNotFound
+	}
+	_, _, _, err := env.run(t, "grp1", "test.ping")
+	if err == nil || !strings.Contains(err.Error(), "install salt or use --salt-path") {
+		t.Errorf("runMain() without salt = %v", err)
+	}
+	if env.api.calls != 0 {
+		t.Errorf("the API was called %d times without salt", env.api.calls)
+	}
+}
+
+func TestRunMainCount(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.devices = append(env.api.devices, userapi.Device{GroupName: "grp3", DeviceName: "dev4", SaltId: 4})
+	stdout, _, _, err := env.run(t, "--count", "grp1 grp2:dev3 grp3 #9")
+	if err != nil || stdout != "5\n" {
+		t.Errorf("--count of several groups = %q, %v", stdout, err)
+	}
+	if calls := env.saltCalls(t); len(calls) > 0 {
+		t.Errorf("--count ran salt with %q", calls)
+	}
+}
+
+func TestRunMainNodegroup(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, _, _, err := env.run(t, "--as-nodegroup", "ng", "grp1 #9")
+	if err != nil || stdout != "ng: L@pi-1,pi-2,pi-9\n" {
+		t.Errorf("--as-nodegroup = %q, %v", stdout, err)
+	}
+}
+
+func TestRunMainGroupBy(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.devices = []userapi.Device{
+		{GroupName: "grp3", DeviceName: "dev5", SaltId: 5},
+		{GroupName: "grp1", DeviceName: "dev2", SaltId: 2},
+		{GroupName: "grp2", DeviceName: "dev3", SaltId: 3},
+		{GroupName: "grp1", DeviceName: "dev1", SaltId: 1},
+		{GroupName: "grp3", DeviceName: "dev4", SaltId: 4},
+	}
+	stdout, _, _, err := env.run(t, "--groups-only", "--group-by", "grp3 grp1 grp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "grp1\n  dev1\n  dev2\ngrp2\n  dev3\ngrp3\n  dev4\n  dev5\n"
+	if stdout != want {
+		t.Errorf("--group-by printed %q, want %q", stdout, want)
+	}
+}
+
+func TestRunMainNoColor(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.devices = append(env.api.devices, userapi.Device{GroupName: "grp3", DeviceName: "dev4", SaltId: 1})
+	_, stderr, _, err := env.run(t, "grp1:dev1 grp3", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "warning: ") || strings.Contains(stderr, "\x1b[") {
+		t.Errorf("stderr isn't a terminal but has color codes: %q", stderr)
+	}
+}
+
+func TestRunMainStdinQuery(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.stdin = "grp1:dev2\n#7\n"
+	if _, _, _, err := env.run(t, "-", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-2 pi-7][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestReadQuery(t *testing.T) {
+	query, err := readQuery(strings.NewReader("grp1\ngrp2:dev3 #4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(query.Groups, []string{"grp1"}) || len(query.Devices) != 1 || !reflect.DeepEqual(query.SaltIDs, []int{4}) {
+		t.Errorf("readQuery() = %+v", query)
+	}
+	if _, err := readQuery(strings.NewReader("\n")); err == nil {
+		t.Error("readQuery() of empty stdin succeeded")
+	}
+}
+
+func TestRunMainOutputFile(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	outputFile := path.Join(env.dir, "output")
+	for _, exit := range []string{"0", "1"} {
+		restore := setEnv("FAKE_SALT_EXIT", exit)
+		_, _, _, err := env.run(t, "--output-file", outputFile, "#5", "test.ping")
+		restore()
+		if (err == nil) != (exit == "0") {
+			t.Fatalf("runMain() with salt exiting %v = %v", exit, err)
+		}
+		buf, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(buf), "out: ") || !strings.Contains(string(buf), "err: ") {
+			t.Errorf("output file with salt exiting %v = %q", exit, buf)
+		}
+	}
+
+	_, _, _, err := env.run(t, "--output-file", path.Join(env.dir, "missing", "output"), "#5", "test.ping")
+	if err == nil || !strings.Contains(err.Error(), "could not open output file") {
+		t.Errorf("runMain() with an output file that can't be created = %v", err)
+	}
+	if calls := env.saltCalls(t); len(calls) != 2 {
+		t.Errorf("salt was run %d times, it shouldn't run when the output file can't be created", len(calls))
+	}
+}
+
+func TestRunMainFlagQuery(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	_, _, result, err := env.run(t, "--group", "grp2", "--device", "grp1:dev1", "--yes", "cmd.run", "uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-1 pi-3][cmd.run][uptime]`, `[-L][pi-3 pi-1][cmd.run][uptime]`}
+	calls := env.saltCalls(t)
+	if len(calls) != 1 || (calls[0] != want[0] && calls[0] != want[1]) {
+		t.Errorf("salt was run with %q", calls)
+	}
+	if len(result.Devices) != 2 {
+		t.Errorf("ran on %v", result.Devices)
+	}
+	if env.lastQuery != "grp2: grp1:dev1" {
+		t.Errorf("last query = %q", env.lastQuery)
+	}
+}
+
+func TestRunMainExclude(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "--exclude", "grp1:dev2", "grp1", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-1][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestExcludeDevices(t *testing.T) {
+	devices := excludeDevices(testDevices, []string{"GRP1:dev2", "grp9:dev9"})
+	if want := []userapi.Device{testDevices[0], testDevices[2]}; !reflect.DeepEqual(devices, want) {
+		t.Errorf("excludeDevices() = %v, want %v", devices, want)
+	}
+}
+
+func TestRunMain(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, stderr, result, err := env.run(t, "grp1", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-1 pi-2][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+	if !reflect.DeepEqual(result.Devices, testDevices[:2]) || result.ExitCode != 0 {
+		t.Errorf("runMain() = %+v", result)
+	}
+	if stdout != "out: -L pi-1 pi-2 test.ping\n" {
+		t.Errorf("stdout = %q", stdout)
+	}
+	if !strings.Contains(stderr, "err: -L pi-1 pi-2 test.ping\n") {
+		t.Errorf("stderr = %q", stderr)
+	}
+	if env.lastQuery != "grp1" || !reflect.DeepEqual(env.lastDevices, testDevices[:2]) {
+		t.Errorf("last query saved as %q %v", env.lastQuery, env.lastDevices)
+	}
+	audit, err := ioutil.ReadFile(env.auditLog())
+	if err != nil || !strings.Contains(string(audit), `"pi-1","pi-2"`) {
+		t.Errorf("audit log = %q, %v", audit, err)
+	}
+}
+
+func TestRunMainSummary(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	_, stderr, _, err := env.run(t, "grp1", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^Ran test\.ping on 2 devices in [0-9.]+[mµn]?s$`).MatchString(stderr) {
+		t.Errorf("stderr %q doesn't include the summary", stderr)
+	}
+
+	_, stderr, _, err = env.run(t, "--quiet", "grp1", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stderr, "Ran ") {
+		t.Errorf("stderr with --quiet = %q", stderr)
+	}
+}
+
+func TestRunMainGroupCommands(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	config := fmt.Sprintf("server-url: %v\nuser-name: user\naudit-log: %v\ngroup-commands:\n  grp1: [cmd.run, uptime]\n",
+		testServer, env.auditLog())
+	writeFile(t, path.Join(env.dir, "csalt", "cacophony-user.yaml"), config, 0600)
+
+	for _, query := range []string{"grp1:", "GRP1:"} {
+		if _, _, _, err := env.run(t, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, err := env.run(t, "Grp1:", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"[-L][pi-1 pi-2][cmd.run][uptime]", "[-L][pi-1 pi-2][cmd.run][uptime]", "[-L][pi-1 pi-2][test.ping]"}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+
+	// a group without a default command lists its devices
+	stdout, _, _, err := env.run(t, "grp2:")
+	if err != nil || stdout != "grp2:dev3\n" {
+		t.Errorf("runMain() of a group without a command = %q, %v", stdout, err)
+	}
+	if calls := env.saltCalls(t); len(calls) != len(want) {
+		t.Errorf("salt was run with %q, a group without a command shouldn't run it", calls)
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	command := shellCommand([]string{"sudo", "salt", "", `"pi-1 pi-2"`, "cmd.run", "echo it's"})
+	want := `sudo salt '' '"pi-1 pi-2"' cmd.run 'echo it'\''s'`
+	if command != want {
+		t.Errorf("shellCommand() = %v, want %v", command, want)
+	}
+}
+
+func TestRunMainSaltTimeout(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "--salt-timeout", "30", "#5", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-t][30][-L][pi-5][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestRunMainTargetLength(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	config := fmt.Sprintf("server-url: %v\nuser-name: user\naudit-log: %v\nmax-target-length: 5\n", testServer, env.auditLog())
+	writeFile(t, path.Join(env.dir, "csalt", "cacophony-user.yaml"), config, 0600)
+
+	_, stderr, _, err := env.run(t, "grp1", "test.ping")
+	if err != nil || !strings.Contains(stderr, "the salt target for 2 devices is 9 characters") {
+		t.Errorf("runMain() with a long target = %v, stderr %q", err, stderr)
+	}
+	_, stderr, _, err = env.run(t, "--chunk-size", "1", "grp1", "test.ping")
+	if err != nil || strings.Contains(stderr, "the salt target") {
+		t.Errorf("runMain() with short chunks = %v, stderr %q", err, stderr)
+	}
+	if calls := env.saltCalls(t); len(calls) != 3 {
+		t.Errorf("salt was run with %q, a long target should only be warned about", calls)
+	}
+}
+
+func TestLoginAndExit(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	server := newTokenServer(testJWT(time.Now().Add(time.Hour)))
+	defer server.Close()
+	env.writeConfig(t, server.URL)
+
+	if _, _, _, err := env.run(t, "--login"); err == nil || !strings.Contains(err.Error(), userapi.TokenEnv) {
+		t.Errorf("--login with %v set = %v", userapi.TokenEnv, err)
+	}
+
+	defer setEnv(userapi.TokenEnv, "")()
+	defer setEnv(passwordEnv, "secret")()
+	// the expired token is saved so the token file in the home directory isn't
+	// read
+	env.writeToken(t, server.URL, testJWT(time.Now().Add(-time.Hour)))
+	_, stderr, _, err := env.run(t, "--login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.logins != 1 || server.saves != 1 || !strings.Contains(env.savedToken(t), "saved-token") {
+		t.Errorf("--login logged in %d times and saved %d tokens: %q", server.logins, server.saves, env.savedToken(t))
+	}
+	if !strings.Contains(stderr, "Logged in as user on "+server.URL) {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
+
+func TestRunMainNoPrefix(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "--no-prefix", "grp1", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][1 2][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestRunMainFilter(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	if _, _, _, err := env.run(t, "--filter", "2$", "grp1 grp2", "test.ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`[-L][pi-2][test.ping]`}
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+}
+
+func TestFilterDevices(t *testing.T) {
+	devices := filterDevices(testDevices, regexp.MustCompile(`[13]$`))
+	if want := []userapi.Device{testDevices[0], testDevices[2]}; !reflect.DeepEqual(devices, want) {
+		t.Errorf("filterDevices() = %v, want %v", devices, want)
+	}
+}
+
+func TestRunMainStrict(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	env.api.devices = append(env.api.devices, userapi.Device{GroupName: "grp3", DeviceName: "dev4", SaltId: 1})
+	_, stderr, _, err := env.run(t, "grp1:dev1 grp3", "test.ping")
+	if err != nil || !strings.Contains(stderr, "#1 is used by grp1:dev1 and grp3:dev4") {
+		t.Errorf("runMain() with a duplicate salt id = %v, stderr %q", err, stderr)
+	}
+	_, _, result, err := env.run(t, "--strict", "grp1:dev1 grp3", "test.ping")
+	if err == nil || result.ExitCode != internalErrorCode {
+		t.Errorf("runMain() with --strict = %d, %v", result.ExitCode, err)
+	}
+	if calls := env.saltCalls(t); len(calls) != 1 {
+		t.Errorf("salt was run with %q, --strict should stop it running", calls)
+	}
+}
+
+func TestDuplicateSaltIDs(t *testing.T) {
+	if err := duplicateSaltIDs(append(testDevices, userapi.Device{SaltId: 1}, userapi.Device{GroupName: "GRP1", DeviceName: "DEV1", SaltId: 1})); err != nil {
+		t.Errorf("duplicateSaltIDs() of the same device = %v", err)
+	}
+	err := duplicateSaltIDs(append(testDevices, userapi.Device{GroupName: "grp2", DeviceName: "dev4", SaltId: 2}))
+	if err == nil || !strings.Contains(err.Error(), "#2 is used by grp1:dev2 and grp2:dev4") {
+		t.Errorf("duplicateSaltIDs() = %v", err)
+	}
+}
+
+func TestRunMainRepeatAndChunks(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	_, stderr, _, err := env.run(t, "--repeat", "2", "--interval", "1ms", "--chunk-size", "2", "grp1 grp2", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{`[-L][pi-1 pi-2][test.ping]`, `[-L][pi-3][test.ping]`}
+	want := append(chunks, chunks...)
+	if calls := env.saltCalls(t); !reflect.DeepEqual(calls, want) {
+		t.Errorf("salt was run with %q, want %q", calls, want)
+	}
+	if !strings.Contains(stderr, "Repeating, run 2 of 2") {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
+
+func TestRunMainJSONLog(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	stdout, stderr, _, err := env.run(t, "--log-format", "json", "grp1", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "out: -L pi-1 pi-2 test.ping\n" {
+		t.Errorf("stdout = %q", stdout)
+	}
+	var summary map[string]interface{}
+	for _, line := range strings.Split(stderr, "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid json %q: %v", line, err)
+		}
+		if message, _ := entry["message"].(string); strings.HasPrefix(message, "Ran test.ping") {
+			summary = entry
+		}
+	}
+	if summary == nil || summary["level"] != "info" || summary["devices"] != 2.0 {
+		t.Errorf("summary = %v in %q", summary, stderr)
+	}
+}
+
+func TestRunMainShowTargets(t *testing.T) {
+	env, cleanup := newTestEnv(t)
+	defer cleanup()
+	_, stderr, _, err := env.run(t, "--show-targets", "grp1", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "grp1:dev1 -> pi-1\ngrp1:dev2 -> pi-2\n") {
+		t.Errorf("stderr = %q", stderr)
+	}
+
+	_, stderr, _, err = env.run(t, "--show-targets", "-q", "grp1", "test.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stderr != "err: -L pi-1 pi-2 test.ping\n" {
+		t.Errorf("stderr with --quiet = %q", stderr)
+	}
+}
+
+func TestPickDevice(t *testing.T) {
+	var out strings.Builder
+	device, err := pickDevice(strings.NewReader("2\n"), &out, "dev", testDevices)
+	if err != nil || device != testDevices[1] {
+		t.Errorf("pickDevice() = %v, %v", device, err)
+	}
+	if !strings.Contains(out.String(), "  3) grp2:dev3\n") {
+		t.Errorf("pickDevice() printed %q", out.String())
+	}
+	for _, answer := range []string{"0\n", "4\n", "dev\n", ""} {
+		if _, err := pickDevice(strings.NewReader(answer), &out, "dev", testDevices); err == nil {
+			t.Errorf("pickDevice() with %q succeeded", answer)
+		}
+	}
+}
+
+func TestUnmatchedNames(t *testing.T) {
+	query, err := resolver.ParseQuery("GRP1 dev3 grp2:dev9 other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := unmatchedNames(query, testDevices[:2])
+	if want := []string{"dev3", "other"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("unmatchedNames() = %v, want %v", names, want)
+	}
+	if named := namedDevices(testDevices, "DEV3"); !reflect.DeepEqual(named, testDevices[2:]) {
+		t.Errorf("namedDevices() = %v", named)
+	}
+}
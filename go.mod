@@ -1,12 +1,12 @@
 module github.com/TheCacophonyProject/csalt
 
-go 1.12
+go 1.13
 
 require (
 	github.com/alexflint/go-arg v1.1.0
 	github.com/gofrs/flock v0.7.1
 	github.com/howeyc/gopass v0.0.0-20190910152052-7cb4b85ec19c
 	github.com/spf13/afero v1.2.2
-	golang.org/x/crypto v0.0.0-20190909091759-094676da4a83 // indirect
+	golang.org/x/crypto v0.0.0-20190909091759-094676da4a83
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,198 @@
+package resolver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const saltIDPrefix = "saltid:"
+
+// DeviceQuery is a parsed list of groups, devices and salt ids
+type DeviceQuery struct {
+	Devices []userapi.Device
+	Groups  []string
+	SaltIDs []int
+	RawArg  string
+}
+
+// ParseQuery parses a space separated list of groups, devices in the format
+// <groupname>:<devicename> and salt ids in the format #<saltid>, names
+// containing spaces can be quoted
+func ParseQuery(query string) (*DeviceQuery, error) {
+	devQ := &DeviceQuery{}
+	if err := devQ.UnmarshalText([]byte(query)); err != nil {
+		return nil, err
+	}
+	return devQ, nil
+}
+
+func (devQ *DeviceQuery) HasValues() bool {
+	return devQ.HasNames() || len(devQ.SaltIDs) > 0
+}
+
+// HasNames returns true if the query has groups or devices that need to be
+// translated by the API
+func (devQ *DeviceQuery) HasNames() bool {
+	return len(devQ.Devices) > 0 || len(devQ.Groups) > 0
+}
+
+// BareNames returns the groups in the query that were written without a :,
+// these may also be device names given without their group
+func (devQ *DeviceQuery) BareNames() []string {
+	tokens, err := splitQuery(devQ.RawArg)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, token := range tokens {
+		if !strings.Contains(token, ":") && !strings.HasPrefix(token, "#") {
+			names = append(names, token)
+		}
+	}
+	return names
+}
+
+// SaltDevices returns a device for each salt id in the query
+func (devQ *DeviceQuery) SaltDevices() []userapi.Device {
+	devices := make([]userapi.Device, len(devQ.SaltIDs))
+	for i, id := range devQ.SaltIDs {
+		devices[i] = userapi.Device{SaltId: id}
+	}
+	return devices
+}
+
+// Matches returns true if device is one of the devices, salt ids or in one
+// of the groups of the query, names are compared case insensitively
+func (devQ *DeviceQuery) Matches(device userapi.Device) bool {
+	for _, id := range devQ.SaltIDs {
+		if device.SaltId == id {
+			return true
+		}
+	}
+	for _, group := range devQ.Groups {
+		if strings.EqualFold(device.GroupName, group) {
+			return true
+		}
+	}
+	for _, d := range devQ.Devices {
+		if strings.EqualFold(device.GroupName, d.GroupName) && strings.EqualFold(device.DeviceName, d.DeviceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge returns a query for all the groups, devices and salt ids of queries
+func Merge(queries ...*DeviceQuery) *DeviceQuery {
+	merged := &DeviceQuery{}
+	var raw []string
+	for _, devQ := range queries {
+		merged.Groups = append(merged.Groups, devQ.Groups...)
+		merged.Devices = append(merged.Devices, devQ.Devices...)
+		merged.SaltIDs = append(merged.SaltIDs, devQ.SaltIDs...)
+		raw = append(raw, devQ.RawArg)
+	}
+	merged.RawArg = strings.Join(raw, " ")
+	return merged
+}
+
+// parseSaltID returns the salt id from a #<id> or saltid:<id> token
+func parseSaltID(devInfo string) (int, bool, error) {
+	var id string
+	if strings.HasPrefix(devInfo, "#") {
+		id = devInfo[1:]
+	} else if strings.HasPrefix(devInfo, saltIDPrefix) {
+		id = devInfo[len(saltIDPrefix):]
+	} else {
+		return 0, false, nil
+	}
+	saltID, err := strconv.Atoi(id)
+	if err != nil || saltID <= 0 {
+		return 0, true, fmt.Errorf("invalid salt id %v", devInfo)
+	}
+	return saltID, true, nil
+}
+
+// splitQuery splits query into whitespace separated tokens, text in single or
+// double quotes is kept in one token and a backslash escapes the next character
+func splitQuery(query string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	inToken := false
+	var quote rune
+	escaped := false
+	for _, c := range query {
+		switch {
+		case escaped:
+			token.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inToken = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				token.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inToken = true
+		case unicode.IsSpace(c):
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(c)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %v", query)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %v", query)
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+func (devQ *DeviceQuery) UnmarshalText(b []byte) error {
+	devQ.RawArg = string(b)
+	devices, err := splitQuery(string(b))
+	if err != nil {
+		return err
+	}
+
+	for _, devInfo := range devices {
+		saltID, isSaltID, err := parseSaltID(devInfo)
+		if err != nil {
+			return err
+		} else if isSaltID {
+			devQ.SaltIDs = append(devQ.SaltIDs, saltID)
+			continue
+		}
+
+		pos := strings.Index(devInfo, ":")
+		if pos >= 0 {
+			if len(devInfo) == pos+1 {
+				devQ.Groups = append(devQ.Groups, devInfo[:pos])
+			} else {
+				devQ.Devices = append(devQ.Devices, userapi.Device{
+					GroupName:  devInfo[:pos],
+					DeviceName: devInfo[pos+1:]})
+			}
+		} else {
+			devQ.Groups = append(devQ.Groups, devInfo)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package resolver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		groups  []string
+		devices []userapi.Device
+		saltIDs []int
+	}{
+		{query: "grp", groups: []string{"grp"}},
+		{query: "grp:", groups: []string{"grp"}},
+		{query: "grp:dev", devices: []userapi.Device{{GroupName: "grp", DeviceName: "dev"}}},
+		{query: "#12 saltid:34", saltIDs: []int{12, 34}},
+		{query: `"my group":"my device"`, devices: []userapi.Device{{GroupName: "my group", DeviceName: "my device"}}},
+		{query: `'a b' c\ d`, groups: []string{"a b", "c d"}},
+		{query: `"say \"hi\"" grp:'dev 1'`, groups: []string{`say "hi"`}, devices: []userapi.Device{{GroupName: "grp", DeviceName: "dev 1"}}},
+		{query: "  a   b\t", groups: []string{"a", "b"}},
+		{query: "g1 g2:d2 #5", groups: []string{"g1"}, devices: []userapi.Device{{GroupName: "g2", DeviceName: "d2"}}, saltIDs: []int{5}},
+		// groups named mac or serial aren't mistaken for device identifiers
+		{query: "mac:dev1", devices: []userapi.Device{{GroupName: "mac", DeviceName: "dev1"}}},
+		{query: "serial:00:11 mac:", groups: []string{"mac"}, devices: []userapi.Device{{GroupName: "serial", DeviceName: "00:11"}}},
+	}
+	for _, test := range tests {
+		devQ, err := ParseQuery(test.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %v", test.query, err)
+			continue
+		}
+		if devQ.RawArg != test.query {
+			t.Errorf("ParseQuery(%q) RawArg = %q", test.query, devQ.RawArg)
+		}
+		if !reflect.DeepEqual(devQ.Groups, test.groups) {
+			t.Errorf("ParseQuery(%q) groups = %q, want %q", test.query, devQ.Groups, test.groups)
+		}
+		if !reflect.DeepEqual(devQ.Devices, test.devices) {
+			t.Errorf("ParseQuery(%q) devices = %v, want %v", test.query, devQ.Devices, test.devices)
+		}
+		if !reflect.DeepEqual(devQ.SaltIDs, test.saltIDs) {
+			t.Errorf("ParseQuery(%q) salt ids = %v, want %v", test.query, devQ.SaltIDs, test.saltIDs)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		`"grp`,
+		`grp\`,
+		"#",
+		"#abc",
+		"#0",
+		"#-1",
+		"saltid:x",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestHasValues(t *testing.T) {
+	tests := []struct {
+		query  string
+		values bool
+		names  bool
+	}{
+		{query: "", values: false},
+		{query: "grp", values: true, names: true},
+		{query: "grp:dev", values: true, names: true},
+		{query: "#1", values: true},
+	}
+	for _, test := range tests {
+		devQ, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if devQ.HasValues() != test.values {
+			t.Errorf("%q HasValues() = %v", test.query, devQ.HasValues())
+		}
+		if devQ.HasNames() != test.names {
+			t.Errorf("%q HasNames() = %v", test.query, devQ.HasNames())
+		}
+	}
+}
+
+func TestSaltDevices(t *testing.T) {
+	devQ, err := ParseQuery("#3 #4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []userapi.Device{{SaltId: 3}, {SaltId: 4}}
+	if devices := devQ.SaltDevices(); !reflect.DeepEqual(devices, want) {
+		t.Errorf("SaltDevices() = %v, want %v", devices, want)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	devQ, err := ParseQuery("Grp1 grp2:Dev #7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		device  userapi.Device
+		matches bool
+	}{
+		{userapi.Device{GroupName: "grp1", DeviceName: "x", SaltId: 1}, true},
+		{userapi.Device{GroupName: "GRP2", DeviceName: "dev", SaltId: 2}, true},
+		{userapi.Device{GroupName: "grp2", DeviceName: "other", SaltId: 3}, false},
+		{userapi.Device{GroupName: "grp3", DeviceName: "x", SaltId: 7}, true},
+	}
+	for _, test := range tests {
+		if devQ.Matches(test.device) != test.matches {
+			t.Errorf("Matches(%v) = %v", test.device, !test.matches)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, err := ParseQuery("g1 #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseQuery("g2:d2 #2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := Merge(a, b)
+	if merged.RawArg != "g1 #1 g2:d2 #2" {
+		t.Errorf("RawArg = %q", merged.RawArg)
+	}
+	if !reflect.DeepEqual(merged.Groups, []string{"g1"}) ||
+		!reflect.DeepEqual(merged.SaltIDs, []int{1, 2}) ||
+		!reflect.DeepEqual(merged.Devices, []userapi.Device{{GroupName: "g2", DeviceName: "d2"}}) {
+		t.Errorf("Merge() = %+v", merged)
+	}
+}
+
+func TestBareNames(t *testing.T) {
+	devQ, err := ParseQuery(`a ba: grp:dev #3 "c d"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "c d"}
+	if names := devQ.BareNames(); !reflect.DeepEqual(names, want) {
+		t.Errorf("BareNames() = %q, want %q", names, want)
+	}
+}
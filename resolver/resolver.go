@@ -0,0 +1,168 @@
+// Package resolver translates friendly group and device names into salt
+// minion ids and salt arguments, without running salt
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// ErrNoDevices is returned when a query doesn't match any devices
+var ErrNoDevices = errors.New("No valid devices found")
+
+// ErrNoCommand is returned when there is no salt command to run
+var ErrNoCommand = errors.New("A command must be specified")
+
+// Resolver resolves device queries using the Cacophony API
+type Resolver struct {
+	API userapi.API
+	// Prefix is the minion id prefix used by SaltArgs
+	Prefix string
+	// Authenticate is called to re-authenticate when a request fails with an
+	// authentication error, if it is nil the error is returned
+	Authenticate func() error
+	// MaxAuthAttempts is the number of times Authenticate is called
+	MaxAuthAttempts int
+}
+
+// New returns a Resolver for api using the salt prefix that matches the api
+// server, api may be nil if only salt ids will be resolved
+func New(api userapi.API, idPrefix string) *Resolver {
+	return &Resolver{
+		API:             api,
+		Prefix:          idPrefix,
+		MaxAuthAttempts: userapi.DefaultMaxPasswordAttempts,
+	}
+}
+
+// SaltPrefix returns the minion id prefix of the longest host substring
+// in prefixes that matches the server host
+func SaltPrefix(serverURL string, prefixes map[string]string) string {
+	if len(prefixes) == 0 {
+		prefixes = userapi.DefaultSaltPrefixes
+	}
+	idPrefix := userapi.DefaultSaltPrefix
+	url, err := url.Parse(serverURL)
+	if err != nil {
+		// the server url is checked by Config.Validate
+		return idPrefix
+	}
+	matched := -1
+	for host, prefix := range prefixes {
+		if len(host) > matched && strings.Contains(url.Host, host) {
+			matched = len(host)
+			idPrefix = prefix
+		}
+	}
+	return idPrefix
+}
+
+// Resolve parses query and returns the devices it matches
+func (r *Resolver) Resolve(ctx context.Context, query string) ([]userapi.Device, error) {
+	devQ, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return r.ResolveQuery(ctx, devQ)
+}
+
+// ResolveQuery returns the devices matching devQ, salt ids are included
+// without an API lookup
+func (r *Resolver) ResolveQuery(ctx context.Context, devQ *DeviceQuery) ([]userapi.Device, error) {
+	var devices []userapi.Device
+	if devQ.HasNames() {
+		if r.API == nil {
+			return nil, errors.New("an API is required to translate names")
+		}
+		err := r.withAuthentication(func() error {
+			var err error
+			devices, err = r.API.TranslateNamesContext(ctx, devQ.Groups, devQ.Devices)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(devices, devQ.SaltDevices()...), nil
+}
+
+// ListDevices returns all devices the user has access to
+func (r *Resolver) ListDevices(ctx context.Context) ([]userapi.Device, error) {
+	if r.API == nil {
+		return nil, errors.New("an API is required to list devices")
+	}
+	var devices []userapi.Device
+	err := r.withAuthentication(func() error {
+		var err error
+		devices, err = r.API.TranslateNamesContext(ctx, nil, nil)
+		return err
+	})
+	return devices, err
+}
+
+// withAuthentication calls request, authenticating the user and retrying
+// while it fails with an authentication error, up to MaxAuthAttempts times
+func (r *Resolver) withAuthentication(request func() error) error {
+	for attempts := 0; ; attempts++ {
+		err := request()
+		if !userapi.IsAuthenticationError(err) || r.Authenticate == nil || attempts >= r.MaxAuthAttempts {
+			return err
+		}
+		if err := r.Authenticate(); err != nil {
+			return err
+		}
+	}
+}
+
+// ValidDevices splits devices into those with a salt id and those without,
+// a device without a salt id would target the wrong minion
+func ValidDevices(devices []userapi.Device) (valid, invalid []userapi.Device) {
+	for _, device := range devices {
+		if device.SaltId > 0 {
+			valid = append(valid, device)
+		} else {
+			invalid = append(invalid, device)
+		}
+	}
+	return valid, invalid
+}
+
+// MinionID returns the minion id for saltID, an empty prefix returns the salt
+// id without a prefix
+func MinionID(prefix string, saltID int) string {
+	if prefix == "" {
+		return strconv.Itoa(saltID)
+	}
+	return prefix + "-" + strconv.Itoa(saltID)
+}
+
+// MinionIDs returns the minion id of each device
+func (r *Resolver) MinionIDs(devices []userapi.Device) []string {
+	ids := make([]string, len(devices))
+	for i, device := range devices {
+		ids[i] = MinionID(r.Prefix, device.SaltId)
+	}
+	return ids
+}
+
+// Nodegroup returns a salt master nodegroup definition named name for
+// devices
+func (r *Resolver) Nodegroup(name string, devices []userapi.Device) string {
+	return name + ": L@" + strings.Join(r.MinionIDs(devices), ",")
+}
+
+// SaltDeviceString returns the space separated minion ids of devices
+func (r *Resolver) SaltDeviceString(devices []userapi.Device) string {
+	return strings.Join(r.MinionIDs(devices), " ")
+}
+
+// SaltArgs returns the salt arguments targeting devices as a list of minion
+// ids, the command to run should be appended
+func (r *Resolver) SaltArgs(devices []userapi.Device) []string {
+	return []string{"-L", r.SaltDeviceString(devices)}
+}
@@ -0,0 +1,214 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// fakeAPI translates names from a fixed list of devices, failing with
+// authErr until Authenticate has been called
+type fakeAPI struct {
+	userapi.API
+	devices       []userapi.Device
+	authErr       error
+	authenticated bool
+	calls         int
+}
+
+func (f *fakeAPI) TranslateNamesContext(ctx context.Context, groups []string, devices []userapi.Device) ([]userapi.Device, error) {
+	f.calls++
+	if f.authErr != nil && !f.authenticated {
+		return nil, f.authErr
+	}
+	devQ := &DeviceQuery{Groups: groups, Devices: devices}
+	var matched []userapi.Device
+	for _, device := range f.devices {
+		if len(groups) == 0 && len(devices) == 0 || devQ.Matches(device) {
+			matched = append(matched, device)
+		}
+	}
+	return matched, nil
+}
+
+var testDevices = []userapi.Device{
+	{GroupName: "grp1", DeviceName: "dev1", SaltId: 1},
+	{GroupName: "grp1", DeviceName: "dev2", SaltId: 2},
+	{GroupName: "grp2", DeviceName: "dev3", SaltId: 3},
+}
+
+func TestListDevices(t *testing.T) {
+	r := New(&fakeAPI{devices: testDevices}, "pi")
+	devices, err := r.ListDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(devices, testDevices) {
+		t.Errorf("ListDevices() = %v", devices)
+	}
+	if _, err := New(nil, "pi").ListDevices(context.Background()); err == nil {
+		t.Error("listing devices without an API succeeded")
+	}
+}
+
+func TestResolveSaltIDsWithoutAPI(t *testing.T) {
+	r := New(nil, "pi")
+	devices, err := r.Resolve(context.Background(), "#4 saltid:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []userapi.Device{{SaltId: 4}, {SaltId: 5}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("Resolve() = %v, want %v", devices, want)
+	}
+	if _, err := r.Resolve(context.Background(), "grp1"); err == nil {
+		t.Error("resolving a group without an API succeeded")
+	}
+}
+
+func TestSaltPrefix(t *testing.T) {
+	custom := map[string]string{
+		"":                "pi",
+		"example.com":     "ex",
+		"dev.example.com": "dev",
+	}
+	tests := []struct {
+		serverURL string
+		prefixes  map[string]string
+		want      string
+	}{
+		{"https://api.cacophony.org.nz", nil, "pi"},
+		{"https://" + userapi.TestAPIHost, nil, "pi-test"},
+		{"https://api.example.com", custom, "ex"},
+		{"https://dev.example.com", custom, "dev"},
+		{"https://other.org", custom, "pi"},
+		{"://bad", nil, "pi"},
+	}
+	for _, test := range tests {
+		if prefix := SaltPrefix(test.serverURL, test.prefixes); prefix != test.want {
+			t.Errorf("SaltPrefix(%v) = %v, want %v", test.serverURL, prefix, test.want)
+		}
+	}
+}
+
+// authenticationError returns the error a real API returns when it has no
+// token
+func authenticationError(t *testing.T) error {
+	api := userapi.New(&userapi.Config{ServerURL: "https://localhost", UserName: "user"})
+	api.SetCacheMode(userapi.CacheDisabled)
+	_, err := api.TranslateNames([]string{"grp"}, nil)
+	if !userapi.IsAuthenticationError(err) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+	return err
+}
+
+func TestResolveAuthentication(t *testing.T) {
+	api := &fakeAPI{devices: testDevices, authErr: authenticationError(t)}
+	r := New(api, "pi")
+	if _, err := r.Resolve(context.Background(), "grp1"); !userapi.IsAuthenticationError(err) {
+		t.Fatalf("Resolve() without Authenticate error = %v", err)
+	}
+
+	authentications := 0
+	r.Authenticate = func() error {
+		authentications++
+		api.authenticated = true
+		return nil
+	}
+	devices, err := r.Resolve(context.Background(), "grp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || authentications != 1 {
+		t.Errorf("got %d devices after %d authentications", len(devices), authentications)
+	}
+}
+
+func TestResolveAuthenticationAttempts(t *testing.T) {
+	api := &fakeAPI{authErr: authenticationError(t)}
+	r := New(api, "pi")
+	r.MaxAuthAttempts = 2
+	authentications := 0
+	r.Authenticate = func() error {
+		authentications++
+		return nil
+	}
+	if _, err := r.Resolve(context.Background(), "grp1"); !userapi.IsAuthenticationError(err) {
+		t.Errorf("Resolve() error = %v", err)
+	}
+	if authentications != 2 {
+		t.Errorf("authenticated %d times, want 2", authentications)
+	}
+
+	failed := errors.New("wrong password")
+	r.Authenticate = func() error { return failed }
+	if _, err := r.Resolve(context.Background(), "grp1"); err != failed {
+		t.Errorf("Resolve() error = %v, want %v", err, failed)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r := New(&fakeAPI{devices: testDevices}, "pi")
+	devices, err := r.Resolve(context.Background(), "grp2 grp1:dev1 #9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []userapi.Device{testDevices[0], testDevices[2], {SaltId: 9}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("Resolve() = %v, want %v", devices, want)
+	}
+
+	// mac is a group name rather than a MAC address selector
+	macDevice := userapi.Device{GroupName: "mac", DeviceName: "dev1", SaltId: 7}
+	r = New(&fakeAPI{devices: append(testDevices, macDevice)}, "pi")
+	devices, err = r.Resolve(context.Background(), "mac:dev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []userapi.Device{macDevice}; !reflect.DeepEqual(devices, want) {
+		t.Errorf("Resolve(mac:dev1) = %v, want %v", devices, want)
+	}
+}
+
+func TestSaltArgs(t *testing.T) {
+	r := New(nil, "pi")
+	one := []userapi.Device{{SaltId: 1}}
+	if args := r.SaltArgs(one); !reflect.DeepEqual(args, []string{"-L", "pi-1"}) {
+		t.Errorf("SaltArgs() = %q", args)
+	}
+	two := []userapi.Device{{SaltId: 1}, {SaltId: 2}}
+	if args := r.SaltArgs(two); !reflect.DeepEqual(args, []string{"-L", "pi-1 pi-2"}) {
+		t.Errorf("SaltArgs() = %q", args)
+	}
+	if nodegroup := r.Nodegroup("ng", two); nodegroup != "ng: L@pi-1,pi-2" {
+		t.Errorf("Nodegroup() = %v", nodegroup)
+	}
+}
+
+func TestMinionID(t *testing.T) {
+	if id := MinionID("pi", 12); id != "pi-12" {
+		t.Errorf("MinionID() = %v", id)
+	}
+	if id := MinionID("", 12); id != "12" {
+		t.Errorf("MinionID() without a prefix = %v", id)
+	}
+}
+
+func TestValidDevices(t *testing.T) {
+	devices := []userapi.Device{
+		{GroupName: "g", DeviceName: "a", SaltId: 1},
+		{GroupName: "g", DeviceName: "b"},
+		{GroupName: "g", DeviceName: "c", SaltId: 3},
+	}
+	valid, invalid := ValidDevices(devices)
+	if !reflect.DeepEqual(valid, []userapi.Device{devices[0], devices[2]}) {
+		t.Errorf("valid = %v", valid)
+	}
+	if !reflect.DeepEqual(invalid, []userapi.Device{devices[1]}) {
+		t.Errorf("invalid = %v", invalid)
+	}
+}
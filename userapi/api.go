@@ -2,6 +2,9 @@ package userapi
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +13,9 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,42 +28,198 @@ const (
 	ShortTTL    = "short"
 	MediumTTL   = "medium"
 	LongTTL     = "long"
+	jwtScheme   = "JWT "
+
+	maxRedirects = 10
+	// rateLimitRetries is how many times a request is retried when the server
+	// is rate limiting requests, waiting for the Retry-After header delay
+	// which defaults to defaultRetryAfter and is at most maxRetryAfter
+	rateLimitRetries  = 3
+	defaultRetryAfter = time.Second
+	maxRetryAfter     = time.Minute
+
+	// tokens requested for durations shorter than MediumTTLFrom use ShortTTL,
+	// and shorter than LongTTLFrom use MediumTTL
+	MediumTTLFrom = 4 * time.Hour
+	LongTTLFrom   = 24 * time.Hour
+
+	// requestIDHeader is sent with every request so client actions can be
+	// matched to server logs
+	requestIDHeader = "X-Request-Id"
+	// orgHeader is sent with every request when an org is configured, so
+	// multi-tenant servers can route the request
+	orgHeader = "X-Org-Id"
+
+	// OfflineAfter is how long since a device last connected before it is
+	// considered offline
+	OfflineAfter = 24 * time.Hour
+
+	// groups are requested concurrently when more than concurrentGroups
+	// groups are queried
+	concurrentGroups = 4
+	maxWorkers       = 4
 )
 
+// API is the part of CacophonyUserAPI used to authenticate and resolve
+// device names, so it can be replaced with a fake
+type API interface {
+	ServerURL() string
+	User() string
+	HasToken() bool
+	ClearToken()
+	IsAuthenticated() bool
+	NeedsAuthentication() bool
+	Authenticate(password string) error
+	SaveTemporaryToken(ttl string) error
+	LockTokenRefresh() (unlock func(), err error)
+	ReloadToken() bool
+	TranslateNames(groups []string, devices []Device) ([]Device, error)
+	TranslateNamesContext(ctx context.Context, groups []string, devices []Device) ([]Device, error)
+	Messages() []string
+	CheckServerVersion() error
+}
+
 type CacophonyUserAPI struct {
 	username      string
 	httpClient    *http.Client
 	serverURL     string
 	token         string
+	userID        int
 	authenticated bool
+	cacheTTL      time.Duration
+	apiTimeout    time.Duration
+	org           string
+	cacheMode     CacheMode
+	logger        Logger
+	tokenStore    TokenStore
+	requestID     string
+	versionPath   string
+	minVersion    string
+	maxVersion    string
+
+	// mu guards authenticated and messages, which are updated by concurrent
+	// requests
+	mu       sync.Mutex
+	messages []string
+
+	// versionOnce requests the server version once for serverVersion and
+	// serverVersionErr
+	versionOnce      sync.Once
+	serverVersion    string
+	serverVersionErr error
+}
+
+// TTLForDuration returns the server token ttl for a token that should last
+// for duration
+func TTLForDuration(duration time.Duration) string {
+	switch {
+	case duration < MediumTTLFrom:
+		return ShortTTL
+	case duration < LongTTLFrom:
+		return MediumTTL
+	}
+	return LongTTL
 }
 
 // joinURL creates an absolute url with supplied baseURL, and all paths
-func joinURL(baseURL string, paths ...string) string {
+func joinURL(baseURL string, paths ...string) (string, error) {
 
 	u, err := url.Parse(baseURL)
 	if err != nil {
-		return ""
+		return "", fmt.Errorf("invalid server URL %v: %v", baseURL, err)
 	}
 	url := path.Join(paths...)
 	u.Path = path.Join(u.Path, url)
-	return u.String()
+	return u.String(), nil
 }
 
-func New(conf *Config) *CacophonyUserAPI {
+func New(conf *Config, options ...DialerOption) *CacophonyUserAPI {
 	api := &CacophonyUserAPI{
-		token:      conf.token,
-		serverURL:  conf.ServerURL,
-		username:   conf.UserName,
-		httpClient: newHTTPClient(),
+		token:       conf.token,
+		userID:      conf.userID,
+		cacheTTL:    conf.CacheTTL,
+		apiTimeout:  conf.APITimeout,
+		logger:      defaultLogger(),
+		tokenStore:  conf.tokenStore(),
+		serverURL:   conf.ServerURL,
+		username:    conf.UserName,
+		httpClient:  newHTTPClient(conf.tlsConfig, conf.proxyURL(), newDialer(options)),
+		requestID:   newRequestID(),
+		org:         conf.Org,
+		versionPath: conf.ServerVersionPath,
+		minVersion:  conf.MinServerVersion,
+		maxVersion:  conf.MaxServerVersion,
 	}
+	api.httpClient.CheckRedirect = api.checkRedirect
 	return api
 }
 
+// checkRedirect follows up to maxRedirects redirects, removing the
+// Authorization header if the redirect is to a different host so the token
+// isn't sent to it
+func (api *CacophonyUserAPI) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	api.logger.Debugf("redirected to %v", req.URL)
+	if req.URL.Host != via[0].URL.Host {
+		api.logger.Debugf("not sending token to %v", req.URL.Host)
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// withTimeout returns req with a deadline of the api timeout, cancel must be
+// called once the response has been read
+func (api *CacophonyUserAPI) withTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	if api.apiTimeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), api.apiTimeout)
+	return req.WithContext(ctx), cancel
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// RequestID returns the id sent in the X-Request-Id header of every request
+func (api *CacophonyUserAPI) RequestID() string {
+	return api.requestID
+}
+
+// setRequestID sets the X-Request-Id header of req to the api's request id
+func (api *CacophonyUserAPI) setRequestID(req *http.Request) {
+	if api.requestID == "" {
+		return
+	}
+	req.Header.Set(requestIDHeader, api.requestID)
+	api.logger.Debugf("%v %v %v: %v", req.Method, req.URL.Path, requestIDHeader, api.requestID)
+}
+
+// setOrg sets the X-Org-Id header of req if an org is configured
+func (api *CacophonyUserAPI) setOrg(req *http.Request) {
+	if api.org != "" {
+		req.Header.Set(orgHeader, api.org)
+	}
+}
+
+// SetLogger sets the Logger used by the api
+func (api *CacophonyUserAPI) SetLogger(logger Logger) {
+	api.logger = logger
+}
+
 func (api *CacophonyUserAPI) ServerURL() string {
 	return api.serverURL
 }
-func (api *CacophonyUserAPI) authURL() string {
+func (api *CacophonyUserAPI) authURL() (string, error) {
 	return joinURL(api.serverURL, authUserURL)
 
 }
@@ -66,7 +228,17 @@ type Device struct {
 	GroupName  string `json:"groupname"`
 	DeviceName string `json:"devicename"`
 	SaltId     int    `json:"saltId"`
+	// LastSeen is when the device last connected to the server, it is nil
+	// if the server doesn't report it
+	LastSeen *time.Time `json:"lastConnectionTime,omitempty"`
+}
+
+// Online returns true if the device has connected to the server within
+// OfflineAfter, devices without a LastSeen time are assumed to be online
+func (d Device) Online() bool {
+	return d.LastSeen == nil || time.Since(*d.LastSeen) < OfflineAfter
 }
+
 type DeviceReponse struct {
 	Messages   []string `json:"messages"`
 	Devices    []Device `json:"devices"`
@@ -76,13 +248,82 @@ type DeviceReponse struct {
 func (api *CacophonyUserAPI) User() string {
 	return api.username
 }
+
+// UserID returns the id of the authenticated user, or 0 if it isn't known
+func (api *CacophonyUserAPI) UserID() int {
+	return api.userID
+}
 func (api *CacophonyUserAPI) HasToken() bool {
 	return api.token != ""
 }
+
+// TokenExpiry returns when the token expires, or the zero time if the token
+// doesn't have an expiry
+func (api *CacophonyUserAPI) TokenExpiry() (time.Time, error) {
+	return tokenExpiry(api.token)
+}
+
+// TokenExpired returns true if there is no token or it has expired
+func (api *CacophonyUserAPI) TokenExpired() bool {
+	if !api.HasToken() {
+		return true
+	}
+	expiry, err := api.TokenExpiry()
+	return err == nil && !expiry.IsZero() && time.Now().After(expiry)
+}
+
+// ClearToken forgets the token so the user must authenticate again, the
+// saved token isn't changed
+func (api *CacophonyUserAPI) ClearToken() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.token = ""
+	api.authenticated = false
+}
+
 func (api *CacophonyUserAPI) IsAuthenticated() bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
 	return api.authenticated
 }
 
+// setAuthenticated records whether the token was accepted by the result of
+// an authenticated request, errors other than authentication errors don't
+// change it
+func (api *CacophonyUserAPI) setAuthenticated(err error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if err == nil {
+		api.authenticated = true
+	} else if IsAuthenticationError(err) {
+		api.authenticated = false
+	}
+}
+
+// NeedsAuthentication returns true if there is no token or it has expired,
+// once a request has succeeded the token is trusted until one fails with an
+// authentication error
+func (api *CacophonyUserAPI) NeedsAuthentication() bool {
+	if api.IsAuthenticated() {
+		return false
+	}
+	return api.TokenExpired()
+}
+
+// jwtToken returns token with the JWT scheme the server expects, tokens
+// may be returned with or without it
+func jwtToken(token string) string {
+	if strings.HasPrefix(token, jwtScheme) {
+		return token
+	}
+	return jwtScheme + token
+}
+
+// setAuthorization sets the Authorization header of req to the users token
+func (api *CacophonyUserAPI) setAuthorization(req *http.Request) {
+	req.Header.Set("Authorization", jwtToken(api.token))
+}
+
 type tokenResponse struct {
 	Messages []string
 	Token    string
@@ -104,11 +345,20 @@ func (api *CacophonyUserAPI) Authenticate(password string) error {
 	if err != nil {
 		return err
 	}
-	postResp, err := api.httpClient.Post(
-		api.authURL(),
-		"application/json",
-		bytes.NewReader(payload),
-	)
+	authURL, err := api.authURL()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", authURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	api.setRequestID(req)
+	api.setOrg(req)
+	req, cancel := api.withTimeout(req)
+	defer cancel()
+	postResp, err := api.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -124,10 +374,9 @@ func (api *CacophonyUserAPI) Authenticate(password string) error {
 		return fmt.Errorf("decode: %v", err)
 	}
 	api.token = resp.Token
-	api.authenticated = true
-	if err != nil {
-		fmt.Printf("Could not save token %v\n", err)
-	}
+	api.userID = resp.ID
+	api.setAuthenticated(nil)
+	api.logger.Debugf("authenticated as %v", api.username)
 	return nil
 }
 
@@ -144,19 +393,28 @@ func (api *CacophonyUserAPI) SaveTemporaryToken(ttl string) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", joinURL(api.serverURL, "/token"),
-		bytes.NewReader(payload))
+	tokenURL, err := joinURL(api.serverURL, "/token")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", tokenURL, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", api.token)
+	api.setAuthorization(req)
+	api.setRequestID(req)
+	api.setOrg(req)
+	req, cancel := api.withTimeout(req)
+	defer cancel()
 	postResp, err := api.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer postResp.Body.Close()
-	if err := handleHTTPResponse(postResp); err != nil {
+	err = handleHTTPResponse(postResp)
+	api.setAuthenticated(err)
+	if err != nil {
 		return err
 	}
 
@@ -165,23 +423,175 @@ func (api *CacophonyUserAPI) SaveTemporaryToken(ttl string) error {
 	if err := d.Decode(&resp); err != nil {
 		return fmt.Errorf("decode: %v", err)
 	}
-	err = saveTokenConfig("JWT "+resp.Token, api.username)
-	return nil
+	if resp.ID != 0 {
+		api.userID = resp.ID
+	}
+	return saveTokenConfig(api.tokenStore, api.serverURL, jwtToken(resp.Token), api.username, api.userID)
 }
 
+// TranslateNames returns the devices matching the supplied groups and devices
 func (api *CacophonyUserAPI) TranslateNames(groups []string, devices []Device) ([]Device, error) {
+	return api.TranslateNamesContext(context.Background(), groups, devices)
+}
+
+// TranslateNamesContext is TranslateNames with a context for the requests
+func (api *CacophonyUserAPI) TranslateNamesContext(ctx context.Context, groups []string, devices []Device) ([]Device, error) {
+	api.mu.Lock()
+	api.messages = nil
+	api.mu.Unlock()
+	if cached, ok := api.cachedDevices(groups, devices); ok {
+		return cached, nil
+	}
+	var translated []Device
+	var err error
+	if len(groups) > concurrentGroups {
+		translated, err = api.translateConcurrently(ctx, groups, devices)
+	} else {
+		translated, err = api.queryDevices(ctx, groups, devices)
+	}
+	api.setAuthenticated(err)
+	if err != nil {
+		return nil, err
+	}
+	api.cacheDevices(groups, devices, translated)
+	return translated, nil
+}
+
+// translateConcurrently queries each group in parallel with a bounded number
+// of workers, and merges the results in the order of the supplied groups
+func (api *CacophonyUserAPI) translateConcurrently(ctx context.Context, groups []string, devices []Device) ([]Device, error) {
+	queries := len(groups)
+	if len(devices) > 0 {
+		queries++
+	}
+	results := make([][]Device, queries)
+	errs := make([]error, queries)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < maxWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if i < len(groups) {
+					results[i], errs[i] = api.queryDevices(ctx, groups[i:i+1], nil)
+				} else {
+					results[i], errs[i] = api.queryDevices(ctx, nil, devices)
+				}
+			}
+		}()
+	}
+	for i := 0; i < queries; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return UniqueDevices(results...), nil
+}
+
+// UniqueDevices merges device lists removing duplicate devices, devices are
+// kept in the order they are first seen. Devices with a name are the same if
+// they have the same group and name, so devices without a salt id or sharing
+// a salt id are kept. Devices given only by salt id are removed if another
+// device has that salt id
+func UniqueDevices(deviceLists ...[]Device) []Device {
+	namedIDs := make(map[int]bool)
+	for _, devices := range deviceLists {
+		for _, device := range devices {
+			if device.DeviceName != "" {
+				namedIDs[device.SaltId] = true
+			}
+		}
+	}
+	seenNames := make(map[string]bool)
+	seenIDs := make(map[int]bool)
+	var unique []Device
+	for _, devices := range deviceLists {
+		for _, device := range devices {
+			if device.DeviceName != "" {
+				name := device.GroupName + ":" + device.DeviceName
+				if seenNames[name] {
+					continue
+				}
+				seenNames[name] = true
+			} else {
+				if namedIDs[device.SaltId] || seenIDs[device.SaltId] {
+					continue
+				}
+				seenIDs[device.SaltId] = true
+			}
+			unique = append(unique, device)
+		}
+	}
+	return unique
+}
+
+// UniqueSaltIDs removes devices with the same salt id as an earlier device,
+// so each minion is only targeted once. Devices without a salt id are kept
+func UniqueSaltIDs(devices []Device) []Device {
+	seen := make(map[int]bool)
+	var unique []Device
+	for _, device := range devices {
+		if device.SaltId > 0 {
+			if seen[device.SaltId] {
+				continue
+			}
+			seen[device.SaltId] = true
+		}
+		unique = append(unique, device)
+	}
+	return unique
+}
+
+// queryDevices queries the server for groups and devices, waiting and
+// retrying up to rateLimitRetries times if the server is rate limiting requests
+func (api *CacophonyUserAPI) queryDevices(ctx context.Context, groups []string, devices []Device) ([]Device, error) {
+	for attempt := 1; ; attempt++ {
+		found, err := api.queryDevicesOnce(ctx, groups, devices)
+		delay, ok := retryAfter(err)
+		if !ok || attempt > rateLimitRetries {
+			return found, err
+		}
+		api.logger.Debugf("server is rate limiting requests, retrying in %v", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// queryDevicesOnce makes a single request to translate groups and devices
+func (api *CacophonyUserAPI) queryDevicesOnce(ctx context.Context, groups []string, devices []Device) ([]Device, error) {
 	if api.token == "" {
 		return nil, &Error{
 			message:        "No Token Supplied",
 			authentication: true,
 		}
 	}
-	req, err := http.NewRequest("GET", joinURL(api.serverURL, apiBasePath, "/devices/query"), nil)
+	queryURL, err := joinURL(api.serverURL, apiBasePath, "/devices/query")
 	if err != nil {
 		return nil, err
 	}
+	req, err := http.NewRequest("GET", queryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	api.logger.Debugf("translating groups %v devices %v", groups, devices)
 
-	req.Header.Set("Authorization", api.token)
+	api.setAuthorization(req)
+	api.setRequestID(req)
+	api.setOrg(req)
+	req, cancel := api.withTimeout(req)
+	defer cancel()
 	q := req.URL.Query()
 	if groups != nil {
 		json, _ := json.Marshal(groups)
@@ -205,22 +615,121 @@ func (api *CacophonyUserAPI) TranslateNames(groups []string, devices []Device) (
 	if err := d.Decode(&devResp); err != nil {
 		return nil, fmt.Errorf("decode: %v", err)
 	}
-
-	api.authenticated = true
+	api.mu.Lock()
+	api.messages = append(api.messages, devResp.Messages...)
+	api.mu.Unlock()
 	return devResp.Devices, nil
 }
 
-// newHTTPClient initializes and returns a http.Client with default settings
-func newHTTPClient() *http.Client {
+// Messages returns the messages the server sent with the devices from the
+// last TranslateNames, these may explain names that couldn't be translated
+func (api *CacophonyUserAPI) Messages() []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]string(nil), api.messages...)
+}
+
+// UserInfo describes the authenticated user
+type UserInfo struct {
+	UserName  string
+	UserID    int
+	ServerURL string
+	// TokenExpiry is the zero time if the token doesn't expire
+	TokenExpiry time.Time
+}
+
+type userResponse struct {
+	UserData struct {
+		ID       int    `json:"id"`
+		UserName string `json:"username"`
+	} `json:"userData"`
+}
+
+// Whoami checks the token is valid by requesting the users details from the
+// server, an authentication error is returned if the token has expired
+func (api *CacophonyUserAPI) Whoami() (*UserInfo, error) {
+	if api.token == "" {
+		return nil, &Error{
+			message:        "No Token Supplied",
+			authentication: true,
+		}
+	}
+	userURL, err := joinURL(api.serverURL, apiBasePath, "users", api.username)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", userURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	api.setAuthorization(req)
+	api.setRequestID(req)
+	api.setOrg(req)
+	req, cancel := api.withTimeout(req)
+	defer cancel()
+	resp, err := api.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	err = handleHTTPResponse(resp)
+	api.setAuthenticated(err)
+	if err != nil {
+		return nil, err
+	}
+	var userResp userResponse
+	d := json.NewDecoder(resp.Body)
+	if err := d.Decode(&userResp); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+
+	if userResp.UserData.ID != 0 {
+		api.userID = userResp.UserData.ID
+	}
+	info := &UserInfo{
+		UserName:  api.username,
+		UserID:    api.userID,
+		ServerURL: api.serverURL,
+	}
+	info.TokenExpiry, _ = api.TokenExpiry()
+	return info, nil
+}
+
+// CheckConnection makes an unauthenticated request to the server to check it
+// is reachable, any HTTP response is considered a success
+func (api *CacophonyUserAPI) CheckConnection() error {
+	req, err := http.NewRequest("GET", api.serverURL, nil)
+	if err != nil {
+		return err
+	}
+	req, cancel := api.withTimeout(req)
+	defer cancel()
+	resp, err := api.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ListDevices returns all devices the user has access to
+func (api *CacophonyUserAPI) ListDevices() ([]Device, error) {
+	return api.TranslateNames(nil, nil)
+}
+
+// newHTTPClient initializes and returns a http.Client with default settings,
+// tlsConfig may be nil to use the default TLS configuration, proxyURL may be
+// nil to use the proxy from the environment and dialer connects to the server
+func newHTTPClient(tlsConfig *tls.Config, proxyURL *url.URL, dialer *net.Dialer) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
 	return &http.Client{
 		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   timeout, // connection timeout
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
+			Proxy:       proxy,
+			DialContext: dialer.DialContext,
 
+			TLSClientConfig:       tlsConfig,
 			TLSHandshakeTimeout:   timeout,
 			ResponseHeaderTimeout: timeout,
 			ExpectContinueTimeout: 1 * time.Second,
@@ -238,6 +747,11 @@ func handleHTTPResponse(resp *http.Response) error {
 			message:        fmt.Sprintf("API authentication failed (%d):", resp.StatusCode),
 			authentication: true,
 		}
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		return &Error{
+			message:    fmt.Sprintf("API is rate limiting requests (%d)", resp.StatusCode),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	} else if !(isHTTPSuccess(resp.StatusCode)) {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -250,6 +764,25 @@ func handleHTTPResponse(resp *http.Response) error {
 	}
 	return nil
 }
+
+// parseRetryAfter returns the delay in a Retry-After header, which is either
+// seconds or an HTTP date, defaulting to defaultRetryAfter and limited to
+// maxRetryAfter
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	delay := defaultRetryAfter
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = date.Sub(now)
+	}
+	if delay <= 0 {
+		delay = defaultRetryAfter
+	} else if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
+
 func isHTTPSuccess(code int) bool {
 	return code >= 200 && code < 300
 }
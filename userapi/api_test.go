@@ -0,0 +1,632 @@
+package userapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAPIToken = "JWT test-token"
+
+// newTestAPI returns an api for serverURL authenticated with testAPIToken,
+// tokens aren't saved and the device cache is disabled
+func newTestAPI(t testing.TB, serverURL string, options ...ConfigOption) *CacophonyUserAPI {
+	options = append([]ConfigOption{WithServerURL(serverURL), WithUserName("user"), WithNoSaveToken()}, options...)
+	conf, err := NewConfig(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.token = testAPIToken
+	api := New(conf)
+	api.SetCacheMode(CacheDisabled)
+	api.SetLogger(NewStdLogger(ioutil.Discard, ioutil.Discard, false))
+	return api
+}
+
+// writeJSON writes v as the json response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestSaveTemporaryToken(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" || r.Header.Get("Authorization") != testAPIToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		writeJSON(w, map[string]interface{}{"token": "temporary", "id": 9})
+	}))
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+
+	if err := api.SaveTemporaryToken(MediumTTL); err != nil {
+		t.Fatal(err)
+	}
+	if request["ttl"] != MediumTTL {
+		t.Errorf("request = %v", request)
+	}
+	tokens, _ := api.tokenStore.ReadTokens()
+	if found := tokens.find(server.URL, "user"); found == nil || found.Token != "JWT temporary" || found.UserID != 9 {
+		t.Errorf("saved token = %+v", found)
+	}
+
+	api.tokenStore = &failingTokenStore{}
+	if err := api.SaveTemporaryToken(MediumTTL); err == nil || err.Error() != "disk full" {
+		t.Errorf("SaveTemporaryToken() error = %v, want the save error", err)
+	}
+
+	api.ClearToken()
+	if err := api.SaveTemporaryToken(MediumTTL); err == nil {
+		t.Error("SaveTemporaryToken() without a token succeeded")
+	}
+}
+
+// deviceServer serves devices for each group requested, recording the
+// requests it receives
+type deviceServer struct {
+	*httptest.Server
+	devices  map[string][]Device
+	messages []string
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newDeviceServer(devices map[string][]Device) *deviceServer {
+	s := &deviceServer{devices: devices}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *deviceServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	s.mu.Unlock()
+	if r.URL.Path != apiBasePath+"/devices/query" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != testAPIToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var groups []string
+	json.Unmarshal([]byte(r.URL.Query().Get("groups")), &groups)
+	var devices []Device
+	json.Unmarshal([]byte(r.URL.Query().Get("devices")), &devices)
+	resp := DeviceReponse{Messages: s.messages, StatusCode: 200}
+	for _, group := range groups {
+		resp.Devices = append(resp.Devices, s.devices[group]...)
+	}
+	for _, device := range devices {
+		for _, found := range s.devices[device.GroupName] {
+			if found.DeviceName == device.DeviceName {
+				resp.Devices = append(resp.Devices, found)
+			}
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (s *deviceServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func TestTranslateNamesConcurrently(t *testing.T) {
+	devices := make(map[string][]Device)
+	var groups []string
+	var want []Device
+	for i := 1; i <= concurrentGroups+2; i++ {
+		group := fmt.Sprintf("grp%d", i)
+		device := Device{GroupName: group, DeviceName: "dev", SaltId: i}
+		devices[group] = []Device{device}
+		groups = append(groups, group)
+		want = append(want, device)
+	}
+	server := newDeviceServer(devices)
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+
+	found, err := api.TranslateNames(groups, []Device{{GroupName: "grp1", DeviceName: "dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("TranslateNames() = %v, want %v", found, want)
+	}
+	if count := server.requestCount(); count != len(groups)+1 {
+		t.Errorf("%d requests sent, want one for each group and one for the devices", count)
+	}
+}
+
+// BenchmarkTranslateConcurrently resolves more groups than are sent in one
+// request, so each group is requested by the workers
+func BenchmarkTranslateConcurrently(b *testing.B) {
+	devices := make(map[string][]Device)
+	var groups []string
+	for i := 0; i < 4*concurrentGroups; i++ {
+		group := fmt.Sprintf("grp%d", i)
+		for j := 0; j < 10; j++ {
+			devices[group] = append(devices[group], Device{GroupName: group, DeviceName: fmt.Sprintf("dev%d", j), SaltId: i*10 + j + 1})
+		}
+		groups = append(groups, group)
+	}
+	server := newDeviceServer(devices)
+	defer server.Close()
+	api := newTestAPI(b, server.URL)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		found, err := api.translateConcurrently(context.Background(), groups, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(found) != 10*len(groups) {
+			b.Fatalf("found %d devices, want %d", len(found), 10*len(groups))
+		}
+	}
+}
+
+func TestTranslateNamesAuthenticationError(t *testing.T) {
+	server := newDeviceServer(nil)
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+	api.token = "JWT expired"
+	_, err := api.TranslateNames([]string{"grp1"}, nil)
+	if !IsAuthenticationError(err) {
+		t.Errorf("TranslateNames() error = %v, want an authentication error", err)
+	}
+	if api.IsAuthenticated() {
+		t.Error("api shouldn't be authenticated after an authentication error")
+	}
+
+	api.ClearToken()
+	if _, err := api.TranslateNames([]string{"grp1"}, nil); !IsAuthenticationError(err) {
+		t.Errorf("TranslateNames() without a token error = %v", err)
+	}
+	if server.requestCount() != 1 {
+		t.Errorf("request sent without a token")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	var login map[string]string
+	returned := "new-token"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case authUserURL:
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["password"] != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			writeJSON(w, map[string]interface{}{"token": returned, "id": 42})
+		case apiBasePath + "/devices/query":
+			if r.Header.Get("Authorization") != "JWT new-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			writeJSON(w, DeviceReponse{})
+		}
+	}))
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+	api.ClearToken()
+
+	if err := api.Authenticate(""); err == nil {
+		t.Error("Authenticate() with an empty password succeeded")
+	}
+	if err := api.Authenticate("wrong"); !IsAuthenticationError(err) {
+		t.Errorf("Authenticate() with the wrong password error = %v", err)
+	}
+	if err := api.Authenticate("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if login["username"] != "user" {
+		t.Errorf("login = %v", login)
+	}
+	if api.UserID() != 42 || !api.HasToken() || !api.IsAuthenticated() {
+		t.Errorf("user id = %v, has token = %v", api.UserID(), api.HasToken())
+	}
+	// the token is returned without the JWT scheme, which is added when it is
+	// sent
+	if _, err := api.TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Errorf("TranslateNames() after authenticating failed: %v", err)
+	}
+
+	// some servers include the scheme, it shouldn't be added twice
+	returned = "JWT new-token"
+	api.ClearToken()
+	if err := api.Authenticate("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Errorf("TranslateNames() with a token returned with its scheme failed: %v", err)
+	}
+}
+
+func TestUniqueDevices(t *testing.T) {
+	dev1 := Device{GroupName: "grp1", DeviceName: "dev1", SaltId: 1}
+	dev2 := Device{GroupName: "grp1", DeviceName: "dev2", SaltId: 2}
+	shared := Device{GroupName: "grp2", DeviceName: "dev1", SaltId: 1}
+	unassigned := Device{GroupName: "grp2", DeviceName: "new"}
+	unique := UniqueDevices(
+		[]Device{dev1, dev2, unassigned},
+		[]Device{dev2, shared, {SaltId: 1}, {SaltId: 5}, {SaltId: 5}},
+		[]Device{dev1, unassigned, {GroupName: "grp3", DeviceName: "new"}},
+	)
+	want := []Device{dev1, dev2, unassigned, shared, {SaltId: 5}, {GroupName: "grp3", DeviceName: "new"}}
+	if !reflect.DeepEqual(unique, want) {
+		t.Errorf("UniqueDevices() = %v, want %v", unique, want)
+	}
+}
+
+func TestUniqueSaltIDs(t *testing.T) {
+	dev1 := Device{GroupName: "grp1", DeviceName: "dev1", SaltId: 1}
+	shared := Device{GroupName: "grp2", DeviceName: "dev4", SaltId: 1}
+	unassigned := Device{GroupName: "grp2", DeviceName: "new"}
+	unique := UniqueSaltIDs([]Device{dev1, unassigned, shared, {SaltId: 2}, {GroupName: "grp3", DeviceName: "new"}, {SaltId: 2}})
+	want := []Device{dev1, unassigned, {SaltId: 2}, {GroupName: "grp3", DeviceName: "new"}}
+	if !reflect.DeepEqual(unique, want) {
+		t.Errorf("UniqueSaltIDs() = %v, want %v", unique, want)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiBasePath+"/users/user" || r.Header.Get("Authorization") != testAPIToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"userData": map[string]interface{}{"id": 5, "username": "user"}})
+	}))
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+
+	info, err := api.Whoami()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UserName != "user" || info.UserID != 5 || info.ServerURL != server.URL {
+		t.Errorf("Whoami() = %+v", info)
+	}
+
+	api.token = "JWT expired"
+	if _, err := api.Whoami(); !IsAuthenticationError(err) {
+		t.Errorf("Whoami() with an expired token error = %v", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	server := newDeviceServer(nil)
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+	api.TranslateNames([]string{"grp"}, nil)
+	api.TranslateNames([]string{"grp"}, nil)
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if !uuid.MatchString(api.RequestID()) {
+		t.Errorf("RequestID() = %q, want a version 4 UUID", api.RequestID())
+	}
+	for _, req := range server.requests {
+		if id := req.Header.Get(requestIDHeader); id != api.RequestID() {
+			t.Errorf("%v = %q, want %q", requestIDHeader, id, api.RequestID())
+		}
+	}
+	if other := newTestAPI(t, server.URL); other.RequestID() == api.RequestID() {
+		t.Error("each api should have a different request id")
+	}
+}
+
+func TestDeviceOnline(t *testing.T) {
+	recent := time.Now().Add(-time.Hour)
+	old := time.Now().Add(-2 * OfflineAfter)
+	if !(Device{}).Online() || !(Device{LastSeen: &recent}).Online() {
+		t.Error("device should be online")
+	}
+	if (Device{LastSeen: &old}).Online() {
+		t.Error("device should be offline")
+	}
+}
+
+func TestDecodeLastSeen(t *testing.T) {
+	recent := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	body := `{"devices": [
+		{"groupname": "grp", "devicename": "dev1", "saltId": 1, "lastConnectionTime": "` + recent + `"},
+		{"groupname": "grp", "devicename": "dev2", "saltId": 2, "lastConnectionTime": "2000-01-01T00:00:00Z"},
+		{"groupname": "grp", "devicename": "dev3", "saltId": 3}
+	]}`
+	var resp DeviceReponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var online []bool
+	for _, device := range resp.Devices {
+		online = append(online, device.Online())
+	}
+	if want := []bool{true, false, true}; !reflect.DeepEqual(online, want) {
+		t.Errorf("decoded devices online = %v, want %v", online, want)
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		writeJSON(w, DeviceReponse{})
+	}))
+	defer proxy.Close()
+
+	api := newTestAPI(t, "http://api.example.com", WithProxyURL(proxy.URL))
+	if _, err := api.TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxied) != 1 || !strings.HasPrefix(proxied[0], "http://api.example.com"+apiBasePath) {
+		t.Errorf("proxied requests = %v", proxied)
+	}
+}
+
+func TestTranslateNames(t *testing.T) {
+	lastSeen := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	server := newDeviceServer(map[string][]Device{
+		"grp1": {{GroupName: "grp1", DeviceName: "dev1", SaltId: 1, LastSeen: &lastSeen}},
+		"grp2": {{GroupName: "grp2", DeviceName: "dev2", SaltId: 2}},
+	})
+	server.messages = []string{"grp3 not found"}
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+
+	devices, err := api.TranslateNames([]string{"grp1"}, []Device{{GroupName: "grp2", DeviceName: "dev2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].LastSeen == nil || !devices[0].LastSeen.Equal(lastSeen) || devices[1].SaltId != 2 {
+		t.Errorf("TranslateNames() = %+v", devices)
+	}
+	if !reflect.DeepEqual(api.Messages(), server.messages) {
+		t.Errorf("Messages() = %v", api.Messages())
+	}
+	if !api.IsAuthenticated() {
+		t.Error("api should be authenticated after a successful request")
+	}
+	req := server.requests[0]
+	if req.Method != "GET" || req.URL.Query().Get("groups") != `["grp1"]` {
+		t.Errorf("request = %v %v", req.Method, req.URL)
+	}
+	if req.Header.Get("Authorization") != testAPIToken {
+		t.Errorf("Authorization = %q", req.Header.Get("Authorization"))
+	}
+}
+
+func TestRedirectAuthorization(t *testing.T) {
+	var authorization []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		writeJSON(w, DeviceReponse{})
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			authorization = append(authorization, r.Header.Get("Authorization"))
+			http.Redirect(w, r, target.URL, http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	}))
+	defer server.Close()
+
+	api := newTestAPI(t, server.URL)
+	if _, err := api.TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{testAPIToken, ""}
+	if !reflect.DeepEqual(authorization, want) {
+		t.Errorf("Authorization headers = %q, want %q, the token should only be sent to the same host", authorization, want)
+	}
+}
+
+func TestTTLForDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		want     string
+	}{
+		{0, ShortTTL},
+		{time.Hour, ShortTTL},
+		{MediumTTLFrom - time.Nanosecond, ShortTTL},
+		{MediumTTLFrom, MediumTTL},
+		{LongTTLFrom - time.Nanosecond, MediumTTL},
+		{LongTTLFrom, LongTTL},
+		{30 * 24 * time.Hour, LongTTL},
+	}
+	for _, test := range tests {
+		if ttl := TTLForDuration(test.duration); ttl != test.want {
+			t.Errorf("TTLForDuration(%v) = %v, want %v", test.duration, ttl, test.want)
+		}
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	for code, permanent := range map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusNotFound:            true,
+		http.StatusInternalServerError: false,
+		http.StatusBadGateway:          false,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			fmt.Fprint(w, "failed")
+		}))
+		_, err := newTestAPI(t, server.URL).TranslateNames([]string{"grp"}, nil)
+		server.Close()
+		if err == nil || !strings.Contains(err.Error(), "failed") {
+			t.Errorf("%d error = %v", code, err)
+		}
+		if IsPermanentError(err) != permanent || IsAuthenticationError(err) {
+			t.Errorf("%d error permanent = %v", code, IsPermanentError(err))
+		}
+	}
+}
+
+func TestCustomResolver(t *testing.T) {
+	var lookups int
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			lookups++
+			return nil, errors.New("resolver unavailable")
+		},
+	}
+	conf, err := NewConfig(WithServerURL("http://csalt-test.example"), WithUserName("user"), WithNoSaveToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.token = testAPIToken
+	api := New(conf, WithResolver(resolver))
+	api.SetCacheMode(CacheDisabled)
+	if _, err := api.TranslateNames([]string{"grp"}, nil); err == nil {
+		t.Error("TranslateNames() succeeded without resolving the server")
+	}
+	if lookups == 0 {
+		t.Error("the custom resolver wasn't used")
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		want    string
+	}{
+		{"https://api.example.com", "https://api.example.com/api/v1/devices"},
+		{"https://api.example.com/", "https://api.example.com/api/v1/devices"},
+		{"https://example.com/cacophony", "https://example.com/cacophony/api/v1/devices"},
+	}
+	for _, test := range tests {
+		joined, err := joinURL(test.baseURL, apiBasePath, "devices")
+		if err != nil || joined != test.want {
+			t.Errorf("joinURL(%v) = %v, %v, want %v", test.baseURL, joined, err, test.want)
+		}
+	}
+	for _, baseURL := range []string{"://example.com", "http://[::1", "https://example.com/%zz"} {
+		_, err := joinURL(baseURL, apiBasePath)
+		if err == nil || !strings.Contains(err.Error(), "invalid server URL") {
+			t.Errorf("joinURL(%v) error = %v", baseURL, err)
+		}
+	}
+}
+
+func TestAPITimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	api := newTestAPI(t, server.URL, WithAPITimeout(50*time.Millisecond))
+
+	start := time.Now()
+	_, err := api.TranslateNames([]string{"grp"}, nil)
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TranslateNames() error = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", defaultRetryAfter},
+		{"5", 5 * time.Second},
+		{" 5 ", 5 * time.Second},
+		{"0", defaultRetryAfter},
+		{"-3", defaultRetryAfter},
+		{"3600", maxRetryAfter},
+		{"soon", defaultRetryAfter},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), defaultRetryAfter},
+	}
+	for _, test := range tests {
+		if delay := parseRetryAfter(test.header, now); delay != test.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", test.header, delay, test.want)
+		}
+	}
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		writeJSON(w, DeviceReponse{Devices: []Device{{GroupName: "grp", DeviceName: "dev", SaltId: 1}}})
+	}))
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+
+	start := time.Now()
+	devices, err := api.TranslateNames([]string{"grp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || requests != 2 {
+		t.Errorf("got %d devices after %d requests", len(devices), requests)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before the Retry-After delay", elapsed)
+	}
+}
+
+func TestRateLimitCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := api.TranslateNamesContext(ctx, []string{"grp"}, nil); err != context.DeadlineExceeded {
+		t.Errorf("TranslateNamesContext() error = %v, want the context error", err)
+	}
+}
+
+func TestOrgHeader(t *testing.T) {
+	server := newDeviceServer(nil)
+	defer server.Close()
+
+	newTestAPI(t, server.URL).TranslateNames([]string{"grp"}, nil)
+	if _, ok := server.requests[0].Header[orgHeader]; ok {
+		t.Errorf("%v sent without an org", orgHeader)
+	}
+
+	withOrg := func(c *Config) { c.Org = "cacophony" }
+	newTestAPI(t, server.URL, withOrg).TranslateNames([]string{"grp"}, nil)
+	if org := server.requests[1].Header.Get(orgHeader); org != "cacophony" {
+		t.Errorf("%v = %q", orgHeader, org)
+	}
+}
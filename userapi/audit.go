@@ -0,0 +1,64 @@
+package userapi
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+)
+
+const auditLogFileName = ".cacophony-csalt-audit.log"
+
+// AuditEntry records a salt command run on devices
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Server    string    `json:"server"`
+	MinionIDs []string  `json:"minion-ids"`
+	Command   []string  `json:"command"`
+}
+
+// WithAuditLog overrides the configured audit log file
+func WithAuditLog(auditLog string) ConfigOption {
+	return func(c *Config) {
+		c.AuditLog = auditLog
+	}
+}
+
+// auditLogPath returns the configured audit log, or the default audit log in
+// the users home directory
+func (c *Config) auditLogPath() (string, error) {
+	if c.AuditLog != "" {
+		return c.AuditLog, nil
+	}
+	homeDir, err := userHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, auditLogFileName), nil
+}
+
+// WriteAuditLog acquires an exlock and appends a json line recording that
+// command was run on minionIDs to the audit log
+func (c *Config) WriteAuditLog(minionIDs []string, command []string) error {
+	auditPath, err := c.auditLogPath()
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(AuditEntry{
+		Time:      time.Now(),
+		User:      c.UserName,
+		Server:    c.ServerURL,
+		MinionIDs: minionIDs,
+		Command:   command,
+	})
+	if err != nil {
+		return err
+	}
+
+	lockSafeConfig := NewLockSafeConfig(auditPath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return err
+	}
+	defer lockSafeConfig.Unlock()
+	return lockSafeConfig.Append(append(entry, '\n'))
+}
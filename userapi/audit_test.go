@@ -0,0 +1,85 @@
+package userapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// readAuditLog returns the entries in the audit log at auditPath
+func readAuditLog(t *testing.T, auditPath string) []AuditEntry {
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWriteAuditLog(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	conf := &Config{ServerURL: testServer, UserName: "user"}
+
+	if err := conf.WriteAuditLog([]string{"pi-1"}, []string{"test.ping"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.WriteAuditLog([]string{"pi-1", "pi-2"}, []string{"cmd.run", "uptime"}); err != nil {
+		t.Fatal(err)
+	}
+	auditPath := path.Join(home, auditLogFileName)
+	entries := readAuditLog(t, auditPath)
+	if len(entries) != 2 {
+		t.Fatalf("audit log has %d entries, want 2", len(entries))
+	}
+	last := entries[1]
+	if last.User != "user" || last.Server != testServer || last.Time.IsZero() ||
+		!reflect.DeepEqual(last.MinionIDs, []string{"pi-1", "pi-2"}) ||
+		!reflect.DeepEqual(last.Command, []string{"cmd.run", "uptime"}) {
+		t.Errorf("audit entry = %+v", last)
+	}
+	if info, err := os.Stat(auditPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("audit log = %v, %v", info, err)
+	}
+}
+
+func TestWriteAuditLogConcurrently(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	auditPath := path.Join(home, "logs", "audit.log")
+	writeFile(t, auditPath, "", 0600)
+	conf, err := NewConfig(WithServerURL(testServer), WithUserName("user"), WithAuditLog(auditPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := conf.WriteAuditLog([]string{fmt.Sprintf("pi-%d", i)}, []string{"test.ping"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if entries := readAuditLog(t, auditPath); len(entries) != writers {
+		t.Errorf("audit log has %d entries, want %d", len(entries), writers)
+	}
+}
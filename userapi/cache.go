@@ -0,0 +1,141 @@
+package userapi
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	deviceCacheFileName = ".cacophony-device-cache"
+	DefaultCacheTTL     = 10 * time.Minute
+)
+
+// CacheMode controls how TranslateNames uses the device cache
+type CacheMode int
+
+const (
+	// CacheEnabled uses cached devices that haven't expired
+	CacheEnabled CacheMode = iota
+	// CacheRefresh ignores cached devices but saves the new results
+	CacheRefresh
+	// CacheDisabled doesn't read or write the cache
+	CacheDisabled
+)
+
+type deviceCache struct {
+	Entries map[string]deviceCacheEntry `yaml:"entries"`
+}
+
+type deviceCacheEntry struct {
+	Updated time.Time `yaml:"updated"`
+	Devices []Device  `yaml:"devices"`
+}
+
+func deviceCachePath() (string, error) {
+	homeDir, err := userHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, deviceCacheFileName), nil
+}
+
+// cacheKey returns the cache key for a query by this user on this server
+func (api *CacophonyUserAPI) cacheKey(groups []string, devices []Device) string {
+	query, _ := json.Marshal(map[string]interface{}{
+		"server":  api.serverURL,
+		"user":    api.username,
+		"groups":  groups,
+		"devices": devices,
+	})
+	return string(query)
+}
+
+// readDeviceCache acquires a readlock and returns the cached devices for key
+// if they are newer than ttl
+func readDeviceCache(key string, ttl time.Duration) ([]Device, bool) {
+	cachePath, err := deviceCachePath()
+	if err != nil {
+		return nil, false
+	}
+	bytes, err := NewLockSafeConfig(cachePath).Read()
+	if err != nil {
+		return nil, false
+	}
+	var cache deviceCache
+	if err := yaml.Unmarshal(bytes, &cache); err != nil {
+		return nil, false
+	}
+	entry, ok := cache.Entries[key]
+	if !ok || time.Since(entry.Updated) > ttl {
+		return nil, false
+	}
+	return entry.Devices, true
+}
+
+// saveDeviceCache acquires an exlock and saves devices for key, removing any
+// entries older than ttl
+func saveDeviceCache(key string, devices []Device, ttl time.Duration) error {
+	cachePath, err := deviceCachePath()
+	if err != nil {
+		return err
+	}
+	lockSafeConfig := NewLockSafeConfig(cachePath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return err
+	}
+	defer lockSafeConfig.Unlock()
+
+	var cache deviceCache
+	if bytes, err := lockSafeConfig.Read(); err == nil {
+		// a corrupt cache is replaced
+		yaml.Unmarshal(bytes, &cache)
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[string]deviceCacheEntry)
+	}
+	for entryKey, entry := range cache.Entries {
+		if time.Since(entry.Updated) > ttl {
+			delete(cache.Entries, entryKey)
+		}
+	}
+	cache.Entries[key] = deviceCacheEntry{Updated: time.Now(), Devices: devices}
+
+	buf, err := yaml.Marshal(&cache)
+	if err != nil {
+		return err
+	}
+	return lockSafeConfig.Write(buf)
+}
+
+// SetCacheMode sets how TranslateNames uses the device cache
+func (api *CacophonyUserAPI) SetCacheMode(mode CacheMode) {
+	api.cacheMode = mode
+}
+
+// cachedDevices returns the cached devices for the query if the cache is
+// enabled and they haven't expired
+func (api *CacophonyUserAPI) cachedDevices(groups []string, devices []Device) ([]Device, bool) {
+	if api.cacheMode != CacheEnabled || api.cacheTTL <= 0 {
+		return nil, false
+	}
+	cached, ok := readDeviceCache(api.cacheKey(groups, devices), api.cacheTTL)
+	if ok {
+		api.logger.Debugf("using cached devices for groups %v devices %v", groups, devices)
+	}
+	return cached, ok
+}
+
+// cacheDevices saves the translated devices for the query if the cache is
+// enabled
+func (api *CacophonyUserAPI) cacheDevices(groups []string, devices []Device, translated []Device) {
+	if api.cacheMode == CacheDisabled || api.cacheTTL <= 0 {
+		return
+	}
+	err := saveDeviceCache(api.cacheKey(groups, devices), translated, api.cacheTTL)
+	if err != nil {
+		api.logger.Warnf("could not save device cache %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package userapi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeviceCache(t *testing.T) {
+	_, cleanup := tempHome(t)
+	defer cleanup()
+	device := Device{GroupName: "grp", DeviceName: "dev", SaltId: 1}
+	server := newDeviceServer(map[string][]Device{"grp": {device}})
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+	api.cacheTTL = time.Minute
+	api.SetCacheMode(CacheEnabled)
+
+	for i := 0; i < 2; i++ {
+		devices, err := api.TranslateNames([]string{"grp"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(devices, []Device{device}) {
+			t.Errorf("TranslateNames() = %v", devices)
+		}
+	}
+	if count := server.requestCount(); count != 1 {
+		t.Errorf("%d requests sent, the second should be a cache hit", count)
+	}
+
+	api.TranslateNames([]string{"other"}, nil)
+	if count := server.requestCount(); count != 2 {
+		t.Errorf("%d requests sent, a different query should be a cache miss", count)
+	}
+
+	api.SetCacheMode(CacheRefresh)
+	api.TranslateNames([]string{"grp"}, nil)
+	if count := server.requestCount(); count != 3 {
+		t.Errorf("%d requests sent, refreshing should skip the cache", count)
+	}
+
+	other := newTestAPI(t, server.URL, WithUserName("other"))
+	other.cacheTTL = time.Minute
+	other.SetCacheMode(CacheEnabled)
+	other.TranslateNames([]string{"grp"}, nil)
+	if count := server.requestCount(); count != 4 {
+		t.Errorf("%d requests sent, devices cached for another user were used", count)
+	}
+}
+
+func TestDeviceCacheExpiry(t *testing.T) {
+	_, cleanup := tempHome(t)
+	defer cleanup()
+	server := newDeviceServer(map[string][]Device{"grp": {{GroupName: "grp", DeviceName: "dev", SaltId: 1}}})
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+	api.cacheTTL = 50 * time.Millisecond
+	api.SetCacheMode(CacheEnabled)
+
+	api.TranslateNames([]string{"grp"}, nil)
+	time.Sleep(2 * api.cacheTTL)
+	api.TranslateNames([]string{"grp"}, nil)
+	if count := server.requestCount(); count != 2 {
+		t.Errorf("%d requests sent, the cached devices should have expired", count)
+	}
+}
+
+func TestDeviceCacheErrorsNotCached(t *testing.T) {
+	_, cleanup := tempHome(t)
+	defer cleanup()
+	server := newDeviceServer(nil)
+	defer server.Close()
+	api := newTestAPI(t, server.URL)
+	api.cacheTTL = time.Minute
+	api.SetCacheMode(CacheEnabled)
+	api.token = "JWT expired"
+
+	for i := 0; i < 2; i++ {
+		if _, err := api.TranslateNames([]string{"grp"}, nil); err == nil {
+			t.Fatal("TranslateNames() with an expired token succeeded")
+		}
+	}
+	if count := server.requestCount(); count != 2 {
+		t.Errorf("%d requests sent, failed requests shouldn't be cached", count)
+	}
+}
@@ -1,93 +1,341 @@
 package userapi
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/gofrs/flock"
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v2"
-	"log"
+	"net/url"
 	"os"
 	"os/user"
-	"path"
+	"strings"
 	"time"
 )
 
 const (
-	userConfig     = "cacophony-user.yaml"
-	tokenFileName  = ".cacophony-token"
-	lockRetryDelay = 678 * time.Millisecond
-	lockTimeout    = 5 * time.Second
+	userConfig            = "cacophony-user.yaml"
+	defaultLockRetryDelay = 678 * time.Millisecond
+	defaultLockTimeout    = 5 * time.Second
+	// exLockAttempts is how many times an exclusive lock is tried for, with
+	// the wait between attempts starting at exLockBackoff and doubling
+	exLockAttempts = 3
+	exLockBackoff  = time.Second
+
+	// LockTimeoutEnv and LockRetryDelayEnv are environment variables that
+	// override how long to wait for file locks and how often to retry, as
+	// durations such as 30s
+	LockTimeoutEnv    = "CSALT_LOCK_TIMEOUT"
+	LockRetryDelayEnv = "CSALT_LOCK_RETRY_DELAY"
+
+	// TokenEnv is an environment variable a token can be supplied in, it is
+	// used instead of the saved token and is never saved
+	TokenEnv = "CSALT_TOKEN"
 )
 
+// ErrConfigMissing is returned when reading a config file that doesn't exist
+var ErrConfigMissing = errors.New("config file is missing")
+
+// ErrConfigEmpty is returned when reading a config file that has no settings
+var ErrConfigEmpty = errors.New("config file is empty")
+
+// ConfigParseError is returned when the config file isn't valid YAML
+type ConfigParseError struct {
+	filePath string
+	err      error
+}
+
+func (e *ConfigParseError) Error() string {
+	return fmt.Sprintf("config file %v is not valid YAML, fix or remove it: %v", e.filePath, e.err)
+}
+
+// IsConfigParseError returns true if err is a ConfigParseError
+func IsConfigParseError(err error) bool {
+	_, ok := err.(*ConfigParseError)
+	return ok
+}
+
+// DefaultMaxPasswordAttempts is used when max-password-attempts isn't set
+const DefaultMaxPasswordAttempts = 3
+
+// DefaultSaltPrefix is the minion id prefix used when no salt prefix matches
+const DefaultSaltPrefix = "pi"
+
+// DefaultSaltPrefixes maps server host substrings to minion id prefixes when
+// salt-prefixes and salt-prefix aren't configured
+var DefaultSaltPrefixes = BaseSaltPrefixes(DefaultSaltPrefix)
+
+// DefaultMaxTargetLength is used when max-target-length isn't set, it is
+// under the 128KiB limit linux has for a single argument
+const DefaultMaxTargetLength = 100000
+
+// DefaultSafeCommands are salt functions that only read from devices, so they
+// are run on many devices without asking for confirmation
+var DefaultSafeCommands = []string{"test.ping", "test.version", "grains.items", "grains.get"}
+
+// BaseSaltPrefixes returns salt prefixes using base for all servers, with a
+// -test suffix for the test server
+func BaseSaltPrefixes(base string) map[string]string {
+	return map[string]string{
+		"":          base,
+		TestAPIHost: base + "-test",
+	}
+}
+
 type Config struct {
-	ServerURL string `yaml:"server-url"`
-	UserName  string `yaml:"user-name"`
-	token     string
-	filePath  string
+	ServerURL           string              `yaml:"server-url"`
+	UserName            string              `yaml:"user-name"`
+	SaltPrefix          string              `yaml:"salt-prefix,omitempty"`
+	SaltPrefixes        map[string]string   `yaml:"salt-prefixes,omitempty"`
+	CacheTTL            time.Duration       `yaml:"cache-ttl,omitempty"`
+	APITimeout          time.Duration       `yaml:"api-timeout,omitempty"`
+	ClientCert          string              `yaml:"client-cert,omitempty"`
+	ClientKey           string              `yaml:"client-key,omitempty"`
+	CACert              string              `yaml:"ca-cert,omitempty"`
+	TokenStore          string              `yaml:"token-store,omitempty"`
+	TokenTTL            string              `yaml:"token-ttl,omitempty"`
+	MaxPasswordAttempts int                 `yaml:"max-password-attempts,omitempty"`
+	MaxTargetLength     int                 `yaml:"max-target-length,omitempty"`
+	ProxyURL            string              `yaml:"proxy-url,omitempty"`
+	Org                 string              `yaml:"org,omitempty"`
+	AuditLog            string              `yaml:"audit-log,omitempty"`
+	InsecureSkipVerify  bool                `yaml:"insecure-skip-verify,omitempty"`
+	MinTLSVersion       string              `yaml:"min-tls-version,omitempty"`
+	NoSaveToken         bool                `yaml:"no-save-token,omitempty"`
+	NoPrefix            bool                `yaml:"no-prefix,omitempty"`
+	SafeCommands        []string            `yaml:"safe-commands,omitempty"`
+	GroupCommands       map[string][]string `yaml:"group-commands,omitempty"`
+	ServerVersionPath   string              `yaml:"server-version-path,omitempty"`
+	MinServerVersion    string              `yaml:"min-server-version,omitempty"`
+	MaxServerVersion    string              `yaml:"max-server-version,omitempty"`
+	token               string
+	userID              int
+	filePath            string
+	savePath            string
+	tokenMismatch       string
+	tokenErr            error
+	tlsConfig           *tls.Config
 }
 
-func userHomeDir() string {
-	usr, err := user.Current()
-	if err != nil {
-		log.Fatal(err)
+// currentUser looks up the user running csalt, it can be replaced to test
+// without the users home directory
+var currentUser = user.Current
+
+// userHomeDir returns the current users home directory, falling back to the
+// HOME or USERPROFILE environment variables if it cannot be looked up
+func userHomeDir() (string, error) {
+	usr, err := currentUser()
+	if err == nil && usr.HomeDir != "" {
+		return usr.HomeDir, nil
+	}
+	for _, env := range []string{"HOME", "USERPROFILE"} {
+		if homeDir := os.Getenv(env); homeDir != "" {
+			return homeDir, nil
+		}
 	}
-	return usr.HomeDir
+	if err == nil {
+		err = errors.New("home directory is not set")
+	}
+	return "", fmt.Errorf("could not find user home directory: %v", err)
 }
 
-func NewConfig() (*Config, error) {
-	homeDir := userHomeDir()
-	filePath := path.Join(homeDir, userConfig)
-	conf := &Config{filePath: filePath}
-	tokenConfig, err := readTokenConfig()
-	if err != nil {
-		fmt.Errorf("error loading token%v", err)
+// ConfigOption overrides a value of the user config
+type ConfigOption func(*Config)
+
+// WithUserName overrides the configured user name, the stored token is only
+// used if it belongs to this user
+func WithUserName(username string) ConfigOption {
+	return func(c *Config) {
+		c.UserName = username
 	}
+}
 
-	if exists, err := afero.Exists(Fs, filePath); err != nil {
-		return conf, err
-	} else if !exists {
-		return conf, errors.New("user config is missing")
+// WithServerURL overrides the configured server url
+func WithServerURL(serverURL string) ConfigOption {
+	return func(c *Config) {
+		c.ServerURL = serverURL
 	}
+}
 
-	err = conf.read()
-	if conf.UserName == tokenConfig.UserName {
-		conf.token = tokenConfig.Token
+// WithTokenTTL overrides the configured ttl of saved tokens
+func WithTokenTTL(ttl string) ConfigOption {
+	return func(c *Config) {
+		c.TokenTTL = ttl
+	}
+}
+
+// WithMaxPasswordAttempts overrides the configured number of password attempts
+func WithMaxPasswordAttempts(attempts int) ConfigOption {
+	return func(c *Config) {
+		c.MaxPasswordAttempts = attempts
+	}
+}
+
+// WithInsecureSkipVerify disables verifying the server's certificate
+func WithInsecureSkipVerify() ConfigOption {
+	return func(c *Config) {
+		c.InsecureSkipVerify = true
+	}
+}
+
+// WithNoSaveToken keeps tokens in memory instead of saving them
+func WithNoSaveToken() ConfigOption {
+	return func(c *Config) {
+		c.NoSaveToken = true
+	}
+}
+
+// WithAPITimeout overrides how long each API request may take
+func WithAPITimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.APITimeout = timeout
+	}
+}
+
+// WithNoPrefix uses salt ids as minion ids without a prefix
+func WithNoPrefix() ConfigOption {
+	return func(c *Config) {
+		c.NoPrefix = true
 	}
+}
 
+// WithProxyURL overrides the configured proxy used to reach the server
+func WithProxyURL(proxyURL string) ConfigOption {
+	return func(c *Config) {
+		c.ProxyURL = proxyURL
+	}
+}
+
+func (c *Config) apply(options []ConfigOption) {
+	for _, option := range options {
+		option(c)
+	}
+}
+
+// NewConfig reads the user config and saved token, applying options over the
+// settings in the file. ErrConfigMissing or ErrConfigEmpty is returned if
+// there is no config and options don't set the server url and user name
+func NewConfig(options ...ConfigOption) (*Config, error) {
+	conf := &Config{}
+	filePath, savePath, err := configFilePaths(userConfig, userConfig)
 	if err != nil {
 		return conf, err
 	}
+	conf.filePath = filePath
+	conf.savePath = savePath
+	conf.CacheTTL = DefaultCacheTTL
+	conf.APITimeout = httpTimeout
+	conf.TokenTTL = LongTTL
+	conf.MaxPasswordAttempts = DefaultMaxPasswordAttempts
+	conf.SafeCommands = DefaultSafeCommands
+	conf.MaxTargetLength = DefaultMaxTargetLength
+	conf.MinTLSVersion = DefaultMinTLSVersion
+
+	err = conf.read()
+	missing := err == ErrConfigMissing || err == ErrConfigEmpty
+	if err != nil && !missing {
+		return conf, err
+	}
+	conf.apply(options)
+	envToken := os.Getenv(TokenEnv)
+	if envToken != "" {
+		// the saved token isn't read, so it can't stop the env token being used
+		conf.token = jwtToken(envToken)
+		conf.NoSaveToken = true
+	}
+	if missing && (conf.ServerURL == "" || conf.UserName == "") {
+		// the config is only needed when the options don't supply the
+		// server and user
+		return conf, err
+	}
 	if err := conf.Validate(); err != nil {
 		return conf, err
 	}
+	if err := conf.loadTLSConfig(); err != nil {
+		return conf, err
+	}
 
+	if envToken != "" {
+		return conf, nil
+	}
+	tokens, err := readTokenConfigs(conf.tokenStore())
+	if err != nil {
+		// authenticating saves a new token over the one that can't be read
+		conf.tokenErr = err
+		return conf, nil
+	}
+	if tokenConfig := tokens.find(conf.ServerURL, conf.UserName); tokenConfig != nil {
+		conf.token = tokenConfig.Token
+		conf.userID = tokenConfig.UserID
+	}
+	conf.tokenMismatch = tokens.mismatch(conf.ServerURL, conf.UserName)
 	return conf, nil
 }
 
-func (c *Config) read() error {
-	if exists, err := afero.Exists(Fs, c.filePath); err != nil {
-		return err
-	} else if !exists {
-		return errors.New("User config is missing")
-	}
+// TokenMismatch lists the saved tokens when none of them are for the user
+// and server, or returns "" if one is used
+func (c *Config) TokenMismatch() string {
+	return c.tokenMismatch
+}
+
+// TokenError returns the error reading the saved token, or nil if it was
+// read, a token that can't be read is ignored
+func (c *Config) TokenError() error {
+	return c.tokenErr
+}
 
+func (c *Config) read() error {
 	lockSafeConfig := NewLockSafeConfig(c.filePath)
-	bytes, err := lockSafeConfig.Read()
+	buf, err := lockSafeConfig.Read()
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(bytes, c)
+	if len(bytes.TrimSpace(buf)) == 0 {
+		return ErrConfigEmpty
+	}
+	if err := yaml.Unmarshal(buf, c); err != nil {
+		return &ConfigParseError{filePath: c.filePath, err: err}
+	}
+	c.expandEnv()
+	return nil
+}
+
+// expandEnv replaces ${VAR} and $VAR in the string fields that may need to
+// differ between users of a shared config, unset variables are replaced with
+// an empty string
+func (c *Config) expandEnv() {
+	for _, field := range []*string{
+		&c.ServerURL,
+		&c.UserName,
+		&c.ClientCert,
+		&c.ClientKey,
+		&c.CACert,
+		&c.ProxyURL,
+		&c.AuditLog,
+		&c.Org,
+		&c.SaltPrefix,
+	} {
+		*field = os.ExpandEnv(*field)
+	}
 }
 
+// Save writes the server url and user name to the config file in the home
+// directory, or in XDG_CONFIG_HOME if it is set. It creates a missing config
+// so other settings are left out to use their defaults
 func (c *Config) Save() error {
-	lockSafeConfig := NewLockSafeConfig(c.filePath)
+	if err := makeConfigDir(c.savePath); err != nil {
+		return err
+	}
+	lockSafeConfig := NewLockSafeConfig(c.savePath)
 	_, err := lockSafeConfig.ExLock()
 	if err != nil {
 		return err
 	}
-	buf, err := yaml.Marshal(&c)
+	defer lockSafeConfig.Unlock()
+	buf, err := yaml.Marshal(&Config{ServerURL: c.ServerURL, UserName: c.UserName})
 	if err != nil {
 		return err
 	}
@@ -99,45 +347,71 @@ func (conf *Config) Validate() error {
 	if conf.ServerURL == "" {
 		return errors.New("server-url missing")
 	}
+	serverURL, err := url.Parse(conf.ServerURL)
+	if err != nil {
+		return fmt.Errorf("server-url %v is invalid: %v", conf.ServerURL, err)
+	}
+	if serverURL.Scheme != "http" && serverURL.Scheme != "https" {
+		return fmt.Errorf("server-url %v must start with http:// or https://", conf.ServerURL)
+	}
+	if serverURL.Host == "" {
+		return fmt.Errorf("server-url %v has no host", conf.ServerURL)
+	}
 
 	if conf.UserName == "" {
 		return errors.New("user-name is missing")
 	}
-	return nil
-}
-
-type TokenConfig struct {
-	UserName string `yaml:"user-name"`
-	Token    string `yaml:"token"`
-}
-
-// readTokenConfig acquires a readlock and reads token config
-func readTokenConfig() (*TokenConfig, error) {
-	tokenPath := path.Join(userHomeDir(), tokenFileName)
-	config := &TokenConfig{}
-	lockSafeConfig := NewLockSafeConfig(tokenPath)
-	bytes, err := lockSafeConfig.Read()
-	if err != nil {
-		return config, err
+	if conf.ProxyURL != "" {
+		proxyURL, err := url.Parse(conf.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("proxy-url %v is invalid: %v", conf.ProxyURL, err)
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return fmt.Errorf("proxy-url %v must be a url such as http://proxy:3128", conf.ProxyURL)
+		}
 	}
-	err = yaml.Unmarshal(bytes, config)
-	return config, err
-}
-
-// readTokenConfig acquires a exlock and saves token config
-func saveTokenConfig(token, username string) error {
-	tokenPath := path.Join(userHomeDir(), tokenFileName)
-	lockSafeConfig := NewLockSafeConfig(tokenPath)
-	_, err := lockSafeConfig.ExLock()
-	if err != nil {
-		return err
+	if strings.ContainsAny(conf.SaltPrefix, " ,") {
+		return fmt.Errorf("salt-prefix %q can't contain spaces or commas", conf.SaltPrefix)
 	}
-	tokenConfig := &TokenConfig{UserName: username, Token: token}
-	buf, err := yaml.Marshal(&tokenConfig)
-	if err != nil {
-		return err
+	switch conf.TokenTTL {
+	case ShortTTL, MediumTTL, LongTTL:
+	default:
+		return fmt.Errorf("token-ttl must be %v, %v or %v", ShortTTL, MediumTTL, LongTTL)
 	}
-	return lockSafeConfig.Write(buf)
+	if conf.MaxPasswordAttempts < 1 {
+		return errors.New("max-password-attempts must be at least 1")
+	}
+	if _, ok := tlsVersions[conf.MinTLSVersion]; !ok {
+		return fmt.Errorf("min-tls-version %q must be 1.0, 1.1, 1.2 or 1.3", conf.MinTLSVersion)
+	}
+	if conf.MaxTargetLength < 1 {
+		return errors.New("max-target-length must be at least 1")
+	}
+	if conf.APITimeout <= 0 {
+		return errors.New("api-timeout must be greater than 0")
+	}
+	if conf.ServerVersionPath != "" && !strings.HasPrefix(conf.ServerVersionPath, "/") {
+		return fmt.Errorf("server-version-path %q must start with /", conf.ServerVersionPath)
+	}
+	for name, version := range map[string]string{
+		"min-server-version": conf.MinServerVersion,
+		"max-server-version": conf.MaxServerVersion,
+	} {
+		if _, ok := parseVersion(version); version != "" && !ok {
+			return fmt.Errorf("%v %q must be a version such as 2.1.0", name, version)
+		}
+	}
+	for group, command := range conf.GroupCommands {
+		if len(command) == 0 {
+			return fmt.Errorf("group-commands for %v is empty", group)
+		}
+	}
+	switch conf.TokenStore {
+	case "", FileTokenStore, KeyringTokenStore:
+	default:
+		return fmt.Errorf("token-store must be %v or %v", FileTokenStore, KeyringTokenStore)
+	}
+	return nil
 }
 
 type LockSafeConfig struct {
@@ -158,28 +432,79 @@ func (lockSafeConfig *LockSafeConfig) Unlock() {
 	lockSafeConfig.fileLock.Unlock()
 }
 
-// ExLock acquires an exclusive lock on confPassword
+// envDuration returns the duration set in the environment variable name, or
+// defaultValue if it isn't set or isn't a positive duration
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	duration, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || duration <= 0 {
+		return defaultValue
+	}
+	return duration
+}
+
+func lockTimeout() time.Duration {
+	return envDuration(LockTimeoutEnv, defaultLockTimeout)
+}
+
+func lockRetryDelay() time.Duration {
+	return envDuration(LockRetryDelayEnv, defaultLockRetryDelay)
+}
+
+// lockError returns the error for a lock on filename that wasn't acquired
+func lockError(filename string, timeout time.Duration, err error) error {
+	if err == nil {
+		err = errors.New("lock is held")
+	}
+	return fmt.Errorf("could not lock %v within %v, another csalt may be using it or set %v to wait longer: %v",
+		filename, timeout, LockTimeoutEnv, err)
+}
+
+// ExLock acquires an exclusive lock on confPassword, trying up to
+// exLockAttempts times with a backoff between attempts
 func (lockSafeConfig *LockSafeConfig) ExLock() (bool, error) {
-	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	timeout := lockTimeout()
+	backoff := exLockBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var locked bool
+		locked, err = lockSafeConfig.tryExLock(timeout)
+		if locked && err == nil {
+			return true, nil
+		}
+		if attempt == exLockAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err == nil {
+		err = errors.New("lock is held")
+	}
+	return false, fmt.Errorf("could not lock %v after %d attempts, another csalt may be using it, run csalt --force-unlock to check if %v is held: %v",
+		lockSafeConfig.filename, exLockAttempts, lockSafeConfig.fileLock.Path(), err)
+}
+
+func (lockSafeConfig *LockSafeConfig) tryExLock(timeout time.Duration) (bool, error) {
+	lockCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	locked, err := lockSafeConfig.fileLock.TryLockContext(lockCtx, lockRetryDelay)
-	return locked, err
+	return lockSafeConfig.fileLock.TryLockContext(lockCtx, lockRetryDelay())
 }
 
-// ReadPassword acquires a readlock and reads the config
+// Read acquires a readlock and reads the config, ErrConfigMissing is returned
+// if the file doesn't exist
 func (lockSafeConfig *LockSafeConfig) Read() ([]byte, error) {
 	locked := lockSafeConfig.fileLock.Locked()
 	if locked == false {
 		locked, err := readLock(lockSafeConfig.fileLock)
 		if locked == false || err != nil {
-			return nil, err
+			return nil, lockError(lockSafeConfig.filename, lockTimeout(), err)
 		}
 		defer lockSafeConfig.Unlock()
 	}
 
 	buf, err := afero.ReadFile(Fs, lockSafeConfig.filename)
 	if os.IsNotExist(err) {
-		return nil, nil
+		return nil, ErrConfigMissing
 	} else if err != nil {
 		return nil, err
 	}
@@ -189,9 +514,9 @@ func (lockSafeConfig *LockSafeConfig) Read() ([]byte, error) {
 
 // readLock  acquires a read lock on the supplied Flock struct
 func readLock(fileLock *flock.Flock) (bool, error) {
-	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout())
 	defer cancel()
-	locked, err := fileLock.TryRLockContext(lockCtx, lockRetryDelay)
+	locked, err := fileLock.TryRLockContext(lockCtx, lockRetryDelay())
 	return locked, err
 }
 
@@ -205,4 +530,56 @@ func (lockSafeConfig *LockSafeConfig) Write(data []byte) error {
 	}
 }
 
+// Append supplied data to the end of exclusively locked file, creating it if
+// it doesn't exist
+func (lockSafeConfig *LockSafeConfig) Append(data []byte) error {
+	if !lockSafeConfig.fileLock.Locked() {
+		return fmt.Errorf("file is not locked %v", lockSafeConfig.filename)
+	}
+	f, err := Fs.OpenFile(lockSafeConfig.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 var Fs = afero.NewOsFs()
+
+// IsSafeCommand returns true if command starts with one of the safe-commands
+func (c *Config) IsSafeCommand(command string) bool {
+	for _, prefix := range c.SafeCommands {
+		if prefix != "" && strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinionPrefixes returns the salt prefixes for each server, salt-prefixes is
+// used if it is configured, otherwise salt-prefix is used as the base prefix
+func (c *Config) MinionPrefixes() map[string]string {
+	if len(c.SaltPrefixes) > 0 {
+		return c.SaltPrefixes
+	}
+	if c.SaltPrefix != "" {
+		return BaseSaltPrefixes(c.SaltPrefix)
+	}
+	return DefaultSaltPrefixes
+}
+
+// proxyURL returns the configured proxy url, or nil to use the proxy from
+// the environment
+func (c *Config) proxyURL() *url.URL {
+	if c.ProxyURL == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil
+	}
+	return proxyURL
+}
@@ -0,0 +1,382 @@
+package userapi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	"gopkg.in/yaml.v2"
+)
+
+// TestMain uses a temporary home directory so tests never read or write the
+// files of the user running them
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "csalt-home")
+	if err != nil {
+		panic(err)
+	}
+	currentUser = func() (*user.User, error) {
+		return &user.User{HomeDir: home}, nil
+	}
+	for _, env := range []string{"XDG_CONFIG_HOME", TokenEnv, LockTimeoutEnv, LockRetryDelayEnv} {
+		os.Unsetenv(env)
+	}
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// tempHome makes a new temporary home directory the current users home
+// directory, cleanup restores the previous one
+func tempHome(t *testing.T) (home string, cleanup func()) {
+	home, err := ioutil.TempDir("", "csalt-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := currentUser
+	currentUser = func() (*user.User, error) {
+		return &user.User{HomeDir: home}, nil
+	}
+	return home, func() {
+		currentUser = previous
+		os.RemoveAll(home)
+	}
+}
+
+// setEnv sets the environment variable name to value, or unsets it if value
+// is "", the returned function restores it
+func setEnv(name, value string) func() {
+	previous, set := os.LookupEnv(name)
+	if value == "" {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, value)
+	}
+	return func() {
+		if set {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func writeFile(t *testing.T, filename, content string, mode os.FileMode) {
+	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile doesn't change the mode of an existing file
+	if err := os.Chmod(filename, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConfigInvalid(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"server-url: [", "not valid YAML"},
+		{"user-name: user\n", "server-url missing"},
+		{"server-url: ftp://example.com\nuser-name: user\n", "must start with http"},
+		{"server-url: https://\nuser-name: user\n", "has no host"},
+		{"server-url: https://example.com\n", "user-name is missing"},
+		{"server-url: https://example.com\nuser-name: user\ntoken-ttl: forever\n", "token-ttl"},
+		{"server-url: https://example.com\nuser-name: user\nmax-password-attempts: -1\n", "max-password-attempts"},
+		{"server-url: https://example.com\nuser-name: user\nmin-tls-version: \"1.4\"\n", "min-tls-version"},
+		{"server-url: https://example.com\nuser-name: user\nproxy-url: proxy\n", "proxy-url"},
+		{"server-url: https://example.com\nuser-name: user\nsalt-prefix: a b\n", "salt-prefix"},
+		{"server-url: https://example.com\nuser-name: user\ntoken-store: vault\n", "token-store"},
+		{"server-url: https://example.com\nuser-name: user\nclient-cert: cert.pem\n", "client-cert and client-key"},
+	}
+	for _, test := range tests {
+		writeFile(t, path.Join(home, userConfig), test.config, 0600)
+		_, err := NewConfig()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("NewConfig() with %q error = %v, want %q", test.config, err, test.err)
+		}
+	}
+	writeFile(t, path.Join(home, userConfig), "server-url: [", 0600)
+	if _, err := NewConfig(); !IsConfigParseError(err) {
+		t.Errorf("IsConfigParseError(%v) = false", err)
+	}
+}
+
+func TestUserHomeDirFallback(t *testing.T) {
+	previous := currentUser
+	defer func() { currentUser = previous }()
+	currentUser = func() (*user.User, error) {
+		return nil, errors.New("no user")
+	}
+	defer setEnv("HOME", "/home/env")()
+	defer setEnv("USERPROFILE", "")()
+	if home, err := userHomeDir(); err != nil || home != "/home/env" {
+		t.Errorf("userHomeDir() = %v, %v, want HOME", home, err)
+	}
+
+	os.Unsetenv("HOME")
+	os.Setenv("USERPROFILE", `C:\Users\env`)
+	if home, err := userHomeDir(); err != nil || home != `C:\Users\env` {
+		t.Errorf("userHomeDir() = %v, %v, want USERPROFILE", home, err)
+	}
+
+	os.Unsetenv("USERPROFILE")
+	if _, err := userHomeDir(); err == nil || !strings.Contains(err.Error(), "no user") {
+		t.Errorf("userHomeDir() error = %v", err)
+	}
+	if _, err := NewConfig(); err == nil {
+		t.Error("NewConfig() without a home directory succeeded")
+	}
+}
+
+func TestNewConfigDefaults(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	writeFile(t, path.Join(home, userConfig), "server-url: https://example.com\nuser-name: user\n", 0600)
+	conf, err := NewConfig(WithAPITimeout(time.Second), WithMaxPasswordAttempts(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.TokenTTL != LongTTL || conf.CacheTTL != DefaultCacheTTL || conf.MinTLSVersion != DefaultMinTLSVersion {
+		t.Errorf("defaults not set: %+v", conf)
+	}
+	if conf.APITimeout != time.Second || conf.MaxPasswordAttempts != 5 {
+		t.Errorf("options not applied: %+v", conf)
+	}
+}
+
+func TestNewConfigMissing(t *testing.T) {
+	_, cleanup := tempHome(t)
+	defer cleanup()
+	if _, err := NewConfig(); err != ErrConfigMissing {
+		t.Errorf("NewConfig() error = %v, want ErrConfigMissing", err)
+	}
+	if _, err := NewConfig(WithServerURL("https://api.example.com")); err != ErrConfigMissing {
+		t.Errorf("NewConfig() with only a server error = %v, want ErrConfigMissing", err)
+	}
+	conf, err := NewConfig(WithServerURL("https://api.example.com"), WithUserName("user"))
+	if err != nil {
+		t.Fatalf("NewConfig() with a server and user failed: %v", err)
+	}
+	if conf.ServerURL != "https://api.example.com" || conf.UserName != "user" {
+		t.Errorf("NewConfig() = %+v", conf)
+	}
+}
+
+func TestNewConfigEmpty(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	writeFile(t, path.Join(home, userConfig), " \n", 0600)
+	if _, err := NewConfig(); err != ErrConfigEmpty {
+		t.Errorf("NewConfig() error = %v, want ErrConfigEmpty", err)
+	}
+}
+
+func TestMinionPrefixes(t *testing.T) {
+	conf := &Config{}
+	if !reflect.DeepEqual(conf.MinionPrefixes(), DefaultSaltPrefixes) {
+		t.Errorf("MinionPrefixes() = %v", conf.MinionPrefixes())
+	}
+	conf.SaltPrefix = "rpi"
+	want := map[string]string{"": "rpi", TestAPIHost: "rpi-test"}
+	if !reflect.DeepEqual(conf.MinionPrefixes(), want) {
+		t.Errorf("MinionPrefixes() with salt-prefix = %v", conf.MinionPrefixes())
+	}
+	conf.SaltPrefixes = map[string]string{"staging.example.com": "stage"}
+	if !reflect.DeepEqual(conf.MinionPrefixes(), conf.SaltPrefixes) {
+		t.Errorf("MinionPrefixes() with salt-prefixes = %v", conf.MinionPrefixes())
+	}
+}
+
+func TestReadLockTimeout(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	defer setEnv(LockTimeoutEnv, "50ms")()
+	defer setEnv(LockRetryDelayEnv, "10ms")()
+	filename := path.Join(home, userConfig)
+	writeFile(t, filename, "user-name: user\n", 0600)
+
+	held := flock.New(filename + ".lock")
+	if _, err := held.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	defer held.Unlock()
+	_, err := NewLockSafeConfig(filename).Read()
+	if err == nil || !strings.Contains(err.Error(), LockTimeoutEnv) {
+		t.Errorf("Read() of a locked file error = %v", err)
+	}
+
+	held.Unlock()
+	if buf, err := NewLockSafeConfig(filename).Read(); err != nil || string(buf) != "user-name: user\n" {
+		t.Errorf("Read() = %q, %v", buf, err)
+	}
+}
+
+func TestEnvDuration(t *testing.T) {
+	defer setEnv(LockTimeoutEnv, "")()
+	if lockTimeout() != defaultLockTimeout {
+		t.Errorf("lockTimeout() = %v", lockTimeout())
+	}
+	for value, want := range map[string]time.Duration{
+		"30s":  30 * time.Second,
+		"-1s":  defaultLockTimeout,
+		"soon": defaultLockTimeout,
+	} {
+		os.Setenv(LockTimeoutEnv, value)
+		if lockTimeout() != want {
+			t.Errorf("lockTimeout() with %v = %v, want %v", value, lockTimeout(), want)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	defer setEnv("CSALT_TEST_USER", "alice")()
+	defer setEnv("CSALT_TEST_UNSET", "")()
+	writeFile(t, path.Join(home, userConfig),
+		"server-url: https://example.com\nuser-name: ${CSALT_TEST_USER}\naudit-log: /logs/$CSALT_TEST_UNSET/audit.log\n", 0600)
+	conf, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.UserName != "alice" {
+		t.Errorf("user-name = %q, want alice", conf.UserName)
+	}
+	if conf.AuditLog != "/logs//audit.log" {
+		t.Errorf("audit-log = %q, unset variables should be empty", conf.AuditLog)
+	}
+}
+
+func TestExLockRetry(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	defer setEnv(LockTimeoutEnv, "50ms")()
+	defer setEnv(LockRetryDelayEnv, "10ms")()
+	filename := path.Join(home, userConfig)
+
+	held := flock.New(filename + ".lock")
+	if _, err := held.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	released := make(chan struct{})
+	go func() {
+		// released during the backoff after the first attempt
+		time.Sleep(exLockBackoff / 2)
+		held.Unlock()
+		close(released)
+	}()
+	lockSafeConfig := NewLockSafeConfig(filename)
+	locked, err := lockSafeConfig.ExLock()
+	<-released
+	if !locked || err != nil {
+		t.Fatalf("ExLock() = %v, %v, want the lock once it is released", locked, err)
+	}
+	defer lockSafeConfig.Unlock()
+	if err := lockSafeConfig.Write([]byte("user-name: user\n")); err != nil {
+		t.Errorf("Write() failed: %v", err)
+	}
+	if err := NewLockSafeConfig(filename).Write(nil); err == nil {
+		t.Error("Write() without a lock succeeded")
+	}
+}
+
+func TestIsSafeCommand(t *testing.T) {
+	conf := &Config{SafeCommands: DefaultSafeCommands}
+	for command, safe := range map[string]bool{
+		"test.ping":    true,
+		"grains.items": true,
+		"cmd.run":      false,
+		"state.apply":  false,
+	} {
+		if conf.IsSafeCommand(command) != safe {
+			t.Errorf("IsSafeCommand(%v) = %v", command, !safe)
+		}
+	}
+	conf.SafeCommands = []string{""}
+	if conf.IsSafeCommand("cmd.run") {
+		t.Error("an empty safe command matched every command")
+	}
+}
+
+func TestConfigFilePathsXDG(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	homePath := path.Join(home, userConfig)
+
+	defer setEnv("XDG_CONFIG_HOME", "")()
+	readPath, savePath, err := configFilePaths(userConfig, userConfig)
+	if err != nil || readPath != homePath || savePath != homePath {
+		t.Errorf("without XDG_CONFIG_HOME paths = %v, %v, %v", readPath, savePath, err)
+	}
+
+	os.Setenv("XDG_CONFIG_HOME", "relative")
+	readPath, savePath, err = configFilePaths(userConfig, userConfig)
+	if err != nil || readPath != homePath || savePath != homePath {
+		t.Errorf("with a relative XDG_CONFIG_HOME paths = %v, %v, %v", readPath, savePath, err)
+	}
+
+	xdgHome := path.Join(home, ".config")
+	xdgPath := path.Join(xdgHome, xdgConfigDir, userConfig)
+	os.Setenv("XDG_CONFIG_HOME", xdgHome)
+	readPath, savePath, err = configFilePaths(userConfig, userConfig)
+	if err != nil || readPath != homePath || savePath != xdgPath {
+		t.Errorf("before saving to XDG_CONFIG_HOME paths = %v, %v, %v", readPath, savePath, err)
+	}
+
+	writeFile(t, homePath, "server-url: https://home.example.com\nuser-name: user\n", 0600)
+	conf, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ServerURL != "https://home.example.com" {
+		t.Errorf("config was not read from the home directory: %v", conf.ServerURL)
+	}
+	if err := conf.Save(); err != nil {
+		t.Fatal(err)
+	}
+	readPath, savePath, err = configFilePaths(userConfig, userConfig)
+	if err != nil || readPath != xdgPath || savePath != xdgPath {
+		t.Errorf("after saving to XDG_CONFIG_HOME paths = %v, %v, %v", readPath, savePath, err)
+	}
+	info, err := os.Stat(path.Dir(xdgPath))
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("config directory = %v, %v", info, err)
+	}
+}
+
+func TestSaveOnlyServerAndUser(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	conf, err := NewConfig(WithServerURL("https://example.com"), WithUserName("user"), WithTokenTTL(ShortTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Save(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(home, userConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]interface{}
+	if err := yaml.Unmarshal(buf, &saved); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"server-url": "https://example.com", "user-name": "user"}
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved config = %v, want %v", saved, want)
+	}
+}
@@ -0,0 +1,46 @@
+package userapi
+
+import (
+	"net"
+	"time"
+)
+
+// DialerOption changes how the API connects to the server
+type DialerOption func(*net.Dialer)
+
+// WithResolver looks up the server with resolver instead of the system
+// resolver, for split horizon DNS
+func WithResolver(resolver *net.Resolver) DialerOption {
+	return func(d *net.Dialer) {
+		d.Resolver = resolver
+	}
+}
+
+// WithoutHappyEyeballs connects to one server address at a time instead of
+// racing IPv6 and IPv4 connections, for IPv6 only networks
+func WithoutHappyEyeballs() DialerOption {
+	return func(d *net.Dialer) {
+		d.DualStack = false
+		d.FallbackDelay = -1
+	}
+}
+
+// WithLocalAddr connects to the server from the local address addr
+func WithLocalAddr(addr net.Addr) DialerOption {
+	return func(d *net.Dialer) {
+		d.LocalAddr = addr
+	}
+}
+
+// newDialer returns the default dialer with options applied
+func newDialer(options []DialerOption) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   timeout, // connection timeout
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+	for _, option := range options {
+		option(dialer)
+	}
+	return dialer
+}
@@ -15,12 +15,17 @@
 
 package userapi
 
+import "time"
+
 // Error is returned by API calling methods. As well as an error
 // message, it includes whether the error is permanent or not.
 type Error struct {
     message        string
     permanent      bool
     authentication bool
+    // retryAfter is how long the server asked to wait before retrying, it
+    // is only set when the server is rate limiting requests
+    retryAfter     time.Duration
 }
 
 // Error implements the error interface.
@@ -64,6 +69,15 @@ func IsPermanentError(err error) bool {
     return true
 }
 
+// retryAfter returns how long to wait before retrying if err is because the
+// server is rate limiting requests
+func retryAfter(err error) (time.Duration, bool) {
+    if apiErr, ok := err.(*Error); ok && apiErr.retryAfter > 0 {
+        return apiErr.retryAfter, true
+    }
+    return 0, false
+}
+
 func temporaryError(err error) *Error {
     return &Error{message: err.Error(), permanent: false}
 }
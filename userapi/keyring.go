@@ -0,0 +1,105 @@
+package userapi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	keyringService = "csalt"
+	keyringAccount = "cacophony-token"
+)
+
+// errSecretMissing is returned by a keyring when no secret is stored
+var errSecretMissing = errors.New("secret not found in keyring")
+
+// keyring stores secrets in the operating system keyring
+type keyring interface {
+	Get(service, account string) (string, error)
+	Set(service, account, secret string) error
+}
+
+// keyringTokenStore saves the tokens in the operating system keyring
+type keyringTokenStore struct {
+	keyring keyring
+}
+
+func (s *keyringTokenStore) ReadTokens() (*TokenConfigs, error) {
+	secret, err := s.keyring.Get(keyringService, keyringAccount)
+	if err == errSecretMissing {
+		return &TokenConfigs{}, nil
+	} else if err != nil {
+		return &TokenConfigs{}, err
+	}
+	return parseTokenConfigs([]byte(secret))
+}
+
+// UpdateTokens reads, updates and saves the tokens, keyrings can't be locked
+// so another process may save a token in between
+func (s *keyringTokenStore) UpdateTokens(update func(*TokenConfigs) bool) (*TokenConfigs, error) {
+	tokens, err := s.ReadTokens()
+	if err != nil {
+		return nil, err
+	}
+	if !update(tokens) {
+		return tokens, nil
+	}
+	buf, err := yaml.Marshal(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, s.keyring.Set(keyringService, keyringAccount, string(buf))
+}
+
+// systemKeyring uses secret-tool on linux and security on macOS
+type systemKeyring struct{}
+
+func (systemKeyring) Get(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	default:
+		return "", fmt.Errorf("keyring token store is not supported on %v", runtime.GOOS)
+	}
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		// both tools fail with a non zero exit status if the secret is missing
+		return "", errSecretMissing
+	} else if err != nil {
+		return "", fmt.Errorf("could not read keyring: %v", err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (systemKeyring) Set(service, account, secret string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("secret-tool", "store", "--label="+service,
+			"service", service, "account", account)
+		cmd.Stdin = strings.NewReader(secret)
+	case "darwin":
+		// commands are read from stdin so the secret isn't in the process arguments
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %v -a %v -X %v\n",
+			service, account, hex.EncodeToString([]byte(secret))))
+	default:
+		return fmt.Errorf("keyring token store is not supported on %v", runtime.GOOS)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not save to keyring: %v %s", err, stderr.Bytes())
+	}
+	return nil
+}
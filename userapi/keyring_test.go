@@ -0,0 +1,85 @@
+package userapi
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeKeyring keeps secrets in memory
+type fakeKeyring struct {
+	secrets map[string]string
+	err     error
+}
+
+func (k *fakeKeyring) Get(service, account string) (string, error) {
+	if k.err != nil {
+		return "", k.err
+	}
+	secret, ok := k.secrets[service+"/"+account]
+	if !ok {
+		return "", errSecretMissing
+	}
+	return secret, nil
+}
+
+func (k *fakeKeyring) Set(service, account, secret string) error {
+	if k.err != nil {
+		return k.err
+	}
+	k.secrets[service+"/"+account] = secret
+	return nil
+}
+
+func TestKeyringTokenStore(t *testing.T) {
+	keyring := &fakeKeyring{secrets: make(map[string]string)}
+	store := &keyringTokenStore{keyring: keyring}
+
+	tokens, err := store.ReadTokens()
+	if err != nil || len(tokens.Tokens) != 0 {
+		t.Fatalf("ReadTokens() of an empty keyring = %+v, %v", tokens, err)
+	}
+	if err := saveTokenConfig(store, testServer, "JWT one", "user", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTokenConfig(store, testServer, "JWT two", "other", 2); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = store.ReadTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := tokens.find(testServer, "user"); found == nil || found.Token != "JWT one" {
+		t.Errorf("token for user = %+v", found)
+	}
+	if found := tokens.find(testServer, "other"); found == nil || found.Token != "JWT two" {
+		t.Errorf("token for other = %+v", found)
+	}
+}
+
+func TestKeyringTokenStoreMigrate(t *testing.T) {
+	keyring := &fakeKeyring{secrets: map[string]string{
+		keyringService + "/" + keyringAccount: "user-name: user\ntoken: legacy\n",
+	}}
+	tokens, err := readTokenConfigs(&keyringTokenStore{keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := tokens.find(testServer, "user"); found == nil || found.Token != "JWT legacy" {
+		t.Errorf("migrated token = %+v", found)
+	}
+	saved, _ := parseTokenConfigs([]byte(keyring.secrets[keyringService+"/"+keyringAccount]))
+	if saved.outdated() {
+		t.Errorf("migrated token wasn't saved: %+v", saved.Tokens)
+	}
+}
+
+func TestKeyringTokenStoreError(t *testing.T) {
+	failed := errors.New("keyring is locked")
+	store := &keyringTokenStore{keyring: &fakeKeyring{err: failed}}
+	if _, err := store.ReadTokens(); err != failed {
+		t.Errorf("ReadTokens() error = %v, want %v", err, failed)
+	}
+	if err := saveTokenConfig(store, testServer, "JWT one", "user", 1); err != failed {
+		t.Errorf("saveTokenConfig() error = %v, want %v", err, failed)
+	}
+}
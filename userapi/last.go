@@ -0,0 +1,77 @@
+package userapi
+
+import (
+	"errors"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const lastQueryFileName = ".cacophony-csalt-last"
+
+// ErrNoLastQuery is returned by ReadLastQuery if no query has been saved
+var ErrNoLastQuery = errors.New("no previous query has been saved")
+
+// LastQuery is the most recently run device query and the devices it
+// resolved to
+type LastQuery struct {
+	Query     string    `yaml:"query"`
+	ServerURL string    `yaml:"server-url"`
+	Devices   []Device  `yaml:"devices"`
+	Time      time.Time `yaml:"time"`
+}
+
+func lastQueryPath() (string, error) {
+	homeDir, err := userHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, lastQueryFileName), nil
+}
+
+// ReadLastQuery acquires a readlock and returns the last saved query
+func ReadLastQuery() (*LastQuery, error) {
+	lastPath, err := lastQueryPath()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := NewLockSafeConfig(lastPath).Read()
+	if err == ErrConfigMissing {
+		return nil, ErrNoLastQuery
+	} else if err != nil {
+		return nil, err
+	}
+	var last LastQuery
+	if err := yaml.Unmarshal(buf, &last); err != nil {
+		return nil, err
+	}
+	if len(last.Devices) == 0 {
+		return nil, ErrNoLastQuery
+	}
+	return &last, nil
+}
+
+// SaveLastQuery acquires an exlock and saves query and the devices it
+// resolved to on serverURL as the last query
+func SaveLastQuery(query, serverURL string, devices []Device) error {
+	lastPath, err := lastQueryPath()
+	if err != nil {
+		return err
+	}
+	buf, err := yaml.Marshal(&LastQuery{
+		Query:     query,
+		ServerURL: serverURL,
+		Devices:   devices,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	lockSafeConfig := NewLockSafeConfig(lastPath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return err
+	}
+	defer lockSafeConfig.Unlock()
+	return lockSafeConfig.Write(buf)
+}
@@ -0,0 +1,42 @@
+package userapi
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLastQuery(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	if _, err := ReadLastQuery(); err != ErrNoLastQuery {
+		t.Errorf("ReadLastQuery() without a saved query error = %v", err)
+	}
+
+	devices := []Device{{GroupName: "grp", DeviceName: "dev", SaltId: 1}, {SaltId: 2}}
+	if err := SaveLastQuery("grp:dev #2", testServer, devices); err != nil {
+		t.Fatal(err)
+	}
+	last, err := ReadLastQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Query != "grp:dev #2" || last.ServerURL != testServer || !reflect.DeepEqual(last.Devices, devices) {
+		t.Errorf("ReadLastQuery() = %+v", last)
+	}
+	if last.Time.IsZero() {
+		t.Error("time of the last query wasn't saved")
+	}
+
+	if err := SaveLastQuery("grp", testServer, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLastQuery(); err != ErrNoLastQuery {
+		t.Errorf("ReadLastQuery() of a query without devices error = %v", err)
+	}
+
+	writeFile(t, path.Join(home, lastQueryFileName), "devices: [", 0600)
+	if _, err := ReadLastQuery(); err == nil || err == ErrNoLastQuery {
+		t.Errorf("ReadLastQuery() of a corrupt file error = %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package userapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger is used to report progress and problems
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+const (
+	colorRed    = "31"
+	colorYellow = "33"
+)
+
+// StdLogger is a Logger using the standard library log package, debug
+// messages are only written when Verbose is set and info messages aren't
+// written when Quiet is set. Warnings and errors are colored when Color is set
+type StdLogger struct {
+	Out     *log.Logger
+	Err     *log.Logger
+	Verbose bool
+	Quiet   bool
+	Color   bool
+}
+
+// colorize wraps s in the ANSI escape codes for color if l.Color is set
+func (l *StdLogger) colorize(color, s string) string {
+	if !l.Color {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// NewStdLogger returns a StdLogger writing debug and info messages to out
+// and warnings and errors to errOut
+func NewStdLogger(out, errOut io.Writer, verbose bool) *StdLogger {
+	return &StdLogger{
+		Out:     log.New(out, "", 0),
+		Err:     log.New(errOut, "", 0),
+		Verbose: verbose,
+	}
+}
+
+// defaultLogger writes to stdout and stderr without debug messages
+func defaultLogger() Logger {
+	return NewStdLogger(os.Stdout, os.Stderr, false)
+}
+
+func (l *StdLogger) Debugf(format string, v ...interface{}) {
+	if l.Verbose {
+		l.Out.Printf(format, v...)
+	}
+}
+
+func (l *StdLogger) Infof(format string, v ...interface{}) {
+	if !l.Quiet {
+		l.Out.Printf(format, v...)
+	}
+}
+
+func (l *StdLogger) Warnf(format string, v ...interface{}) {
+	l.Err.Print(l.colorize(colorYellow, "warning: "+fmt.Sprintf(format, v...)))
+}
+
+func (l *StdLogger) Errorf(format string, v ...interface{}) {
+	l.Err.Print(l.colorize(colorRed, "error: "+fmt.Sprintf(format, v...)))
+}
+
+// JSONLogger is a Logger writing each message as a line of json with the
+// time, level and message, along with any fields set with SetField. Debug
+// messages are only written when Verbose is set and info messages aren't
+// written when Quiet is set
+type JSONLogger struct {
+	Verbose bool
+	Quiet   bool
+
+	mu     sync.Mutex
+	out    *json.Encoder
+	fields map[string]interface{}
+}
+
+// NewJSONLogger returns a JSONLogger writing to out
+func NewJSONLogger(out io.Writer, verbose bool) *JSONLogger {
+	return &JSONLogger{
+		Verbose: verbose,
+		out:     json.NewEncoder(out),
+		fields:  make(map[string]interface{}),
+	}
+}
+
+// SetField adds key with value to every following message
+func (l *JSONLogger) SetField(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fields[key] = value
+}
+
+func (l *JSONLogger) log(level, format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for key, value := range l.fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["message"] = fmt.Sprintf(format, v...)
+	l.out.Encode(entry)
+}
+
+func (l *JSONLogger) Debugf(format string, v ...interface{}) {
+	if l.Verbose {
+		l.log("debug", format, v...)
+	}
+}
+
+func (l *JSONLogger) Infof(format string, v ...interface{}) {
+	if !l.Quiet {
+		l.log("info", format, v...)
+	}
+}
+
+func (l *JSONLogger) Warnf(format string, v ...interface{}) {
+	l.log("warning", format, v...)
+}
+
+func (l *JSONLogger) Errorf(format string, v ...interface{}) {
+	l.log("error", format, v...)
+}
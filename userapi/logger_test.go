@@ -0,0 +1,87 @@
+package userapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdLogger(t *testing.T) {
+	var out, errOut bytes.Buffer
+	logger := NewStdLogger(&out, &errOut, false)
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+	if out.String() != "info 2\n" {
+		t.Errorf("out = %q", out.String())
+	}
+	if errOut.String() != "warning: warn 3\nerror: error 4\n" {
+		t.Errorf("err = %q", errOut.String())
+	}
+
+	out.Reset()
+	logger.Verbose = true
+	logger.Quiet = true
+	logger.Debugf("debug")
+	logger.Infof("info")
+	if out.String() != "debug\n" {
+		t.Errorf("out with verbose and quiet = %q", out.String())
+	}
+}
+
+func TestStdLoggerColor(t *testing.T) {
+	var out, errOut bytes.Buffer
+	logger := NewStdLogger(&out, &errOut, false)
+	logger.Warnf("plain")
+	if strings.Contains(errOut.String(), "\x1b[") {
+		t.Errorf("color codes written without Color: %q", errOut.String())
+	}
+
+	errOut.Reset()
+	logger.Color = true
+	logger.Warnf("warn")
+	logger.Errorf("error")
+	want := "\x1b[33mwarning: warn\x1b[0m\n\x1b[31merror: error\x1b[0m\n"
+	if errOut.String() != want {
+		t.Errorf("err = %q, want %q", errOut.String(), want)
+	}
+	logger.Infof("info")
+	if out.String() != "info\n" {
+		t.Errorf("info messages shouldn't be colored: %q", out.String())
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewJSONLogger(&out, false)
+	logger.SetField("request-id", "abc")
+	logger.Debugf("hidden")
+	logger.Infof("resolved %d devices", 2)
+	logger.Warnf("careful")
+	logger.Quiet = true
+	logger.Infof("hidden")
+	logger.Errorf("failed")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3: %q", len(lines), out.String())
+	}
+	wantLevels := []string{"info", "warning", "error"}
+	wantMessages := []string{"resolved 2 devices", "careful", "failed"}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid json %q: %v", line, err)
+		}
+		if entry["level"] != wantLevels[i] || entry["message"] != wantMessages[i] || entry["request-id"] != "abc" {
+			t.Errorf("entry = %v", entry)
+		}
+		timestamp, _ := entry["time"].(string)
+		if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			t.Errorf("time %q: %v", timestamp, err)
+		}
+	}
+}
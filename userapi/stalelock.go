@@ -0,0 +1,62 @@
+package userapi
+
+import (
+	"os"
+	"path"
+
+	"github.com/gofrs/flock"
+)
+
+// lockFiles returns the lock files csalt uses for the files it keeps in the
+// users home directory and XDG_CONFIG_HOME
+func lockFiles() ([]string, error) {
+	homeDir, err := userHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range []string{userConfig, tokenFileName, auditLogFileName, lastQueryFileName, deviceCacheFileName} {
+		files = append(files, path.Join(homeDir, name)+".lock")
+	}
+	files = append(files, path.Join(homeDir, tokenFileName)+".refresh.lock")
+	if xdgHome := xdgConfigHome(); xdgHome != "" {
+		files = append(files,
+			path.Join(xdgHome, userConfig)+".lock",
+			path.Join(xdgHome, xdgTokenFileName)+".lock",
+			path.Join(xdgHome, xdgTokenFileName)+".refresh.lock")
+	}
+	return files, nil
+}
+
+// StaleLocks returns the lock files left behind by csalt processes that were
+// killed, along with the lock files for extraFiles. A lock file is stale if no
+// process holds its lock, stale lock files are left in place as a lock that
+// isn't held doesn't block csalt, while removing the file would let a process
+// waiting on the old file and a process that creates a new one both hold the
+// lock. Lock files that are held are returned in held
+func StaleLocks(extraFiles ...string) (stale, held []string, err error) {
+	files, err := lockFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, extraFile := range extraFiles {
+		files = append(files, extraFile+".lock")
+	}
+	for _, lockFile := range files {
+		if _, err := Fs.Stat(lockFile); os.IsNotExist(err) {
+			continue
+		}
+		fileLock := flock.New(lockFile)
+		locked, err := fileLock.TryLock()
+		if err != nil {
+			return stale, held, err
+		}
+		if !locked {
+			held = append(held, lockFile)
+			continue
+		}
+		fileLock.Unlock()
+		stale = append(stale, lockFile)
+	}
+	return stale, held, nil
+}
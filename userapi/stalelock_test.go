@@ -0,0 +1,93 @@
+package userapi
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+func TestStaleLocks(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	staleFile := path.Join(home, userConfig+".lock")
+	writeFile(t, staleFile, "", 0600)
+	heldFile := path.Join(home, tokenFileName+".lock")
+	held := flock.New(heldFile)
+	if _, err := held.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	defer held.Unlock()
+	extra := path.Join(home, "audit.log")
+	writeFile(t, extra+".lock", "", 0600)
+
+	stale, heldLocks, err := StaleLocks(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stale, []string{staleFile, extra + ".lock"}) {
+		t.Errorf("stale = %v", stale)
+	}
+	if !reflect.DeepEqual(heldLocks, []string{heldFile}) {
+		t.Errorf("held = %v", heldLocks)
+	}
+	for _, lockFile := range []string{staleFile, heldFile, extra + ".lock"} {
+		if _, err := os.Stat(lockFile); err != nil {
+			t.Errorf("%v was removed: %v", lockFile, err)
+		}
+	}
+}
+
+func TestStaleLocksConcurrently(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	defer setEnv(LockRetryDelayEnv, "1ms")()
+	filename := path.Join(home, userConfig)
+
+	done := make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if _, _, err := StaleLocks(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	var holders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				lockSafeConfig := NewLockSafeConfig(filename)
+				if locked, err := lockSafeConfig.ExLock(); !locked || err != nil {
+					t.Errorf("ExLock() = %v, %v", locked, err)
+					return
+				}
+				if atomic.AddInt32(&holders, 1) > 1 {
+					t.Error("the config lock is held twice")
+				}
+				time.Sleep(100 * time.Microsecond)
+				atomic.AddInt32(&holders, -1)
+				lockSafeConfig.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-checked
+}
@@ -0,0 +1,62 @@
+package userapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/afero"
+)
+
+// DefaultMinTLSVersion is used when min-tls-version isn't set
+const DefaultMinTLSVersion = "1.2"
+
+// tlsVersions maps the min-tls-version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig sets the minimum TLS version and loads the client certificate
+// and CA bundle if configured
+func (c *Config) loadTLSConfig() error {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tlsVersions[c.MinTLSVersion],
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return errors.New("client-cert and client-key must both be set")
+		}
+		certPEM, err := afero.ReadFile(Fs, c.ClientCert)
+		if err != nil {
+			return fmt.Errorf("could not read client-cert: %v", err)
+		}
+		keyPEM, err := afero.ReadFile(Fs, c.ClientKey)
+		if err != nil {
+			return fmt.Errorf("could not read client-key: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CACert != "" {
+		caPEM, err := afero.ReadFile(Fs, c.CACert)
+		if err != nil {
+			return fmt.Errorf("could not read ca-cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in %v", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	c.tlsConfig = tlsConfig
+	return nil
+}
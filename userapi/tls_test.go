@@ -0,0 +1,150 @@
+package userapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTLSServer returns a started TLS server serving no devices, configure
+// changes its TLS config before it is started
+func newTLSServer(configure func(*tls.Config)) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, DeviceReponse{})
+	}))
+	server.TLS = &tls.Config{}
+	if configure != nil {
+		configure(server.TLS)
+	}
+	server.StartTLS()
+	return server
+}
+
+// writeClientCert writes a self signed client certificate and its key to
+// dir, returning their paths
+func writeClientCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "csalt-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = path.Join(dir, "client.pem")
+	keyPath = path.Join(dir, "client-key.pem")
+	writeFile(t, certPath, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), 0600)
+	writeFile(t, keyPath, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), 0600)
+	return certPath, keyPath
+}
+
+// writeServerCA writes the certificate of server to dir, returning its path
+func writeServerCA(t *testing.T, server *httptest.Server, dir string) string {
+	caPath := path.Join(dir, "ca.pem")
+	writeFile(t, caPath, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})), 0600)
+	return caPath
+}
+
+func TestCACert(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	server := newTLSServer(nil)
+	defer server.Close()
+
+	withCA := func(c *Config) { c.CACert = writeServerCA(t, server, home) }
+	if _, err := newTestAPI(t, server.URL, withCA).TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Errorf("TranslateNames() with ca-cert failed: %v", err)
+	}
+
+	writeFile(t, path.Join(home, "empty.pem"), "", 0600)
+	conf := &Config{CACert: path.Join(home, "empty.pem")}
+	if err := conf.loadTLSConfig(); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Errorf("loadTLSConfig() with an empty ca-cert error = %v", err)
+	}
+	conf.CACert = path.Join(home, "missing.pem")
+	if err := conf.loadTLSConfig(); err == nil || !strings.Contains(err.Error(), "ca-cert") {
+		t.Errorf("loadTLSConfig() with a missing ca-cert error = %v", err)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	server := newTLSServer(func(c *tls.Config) {
+		c.ClientAuth = tls.RequireAnyClientCert
+	})
+	defer server.Close()
+
+	withCA := func(c *Config) { c.CACert = writeServerCA(t, server, home) }
+	if _, err := newTestAPI(t, server.URL, withCA).TranslateNames([]string{"grp"}, nil); err == nil {
+		t.Error("connected to a server requiring a client certificate without one")
+	}
+
+	certPath, keyPath := writeClientCert(t, home)
+	withCert := func(c *Config) {
+		c.ClientCert = certPath
+		c.ClientKey = keyPath
+	}
+	if _, err := newTestAPI(t, server.URL, withCA, withCert).TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Errorf("TranslateNames() with a client certificate failed: %v", err)
+	}
+
+	conf := &Config{ClientCert: keyPath, ClientKey: certPath}
+	if err := conf.loadTLSConfig(); err == nil || !strings.Contains(err.Error(), "client certificate") {
+		t.Errorf("loadTLSConfig() with swapped files error = %v", err)
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+
+	if _, err := newTestAPI(t, server.URL).TranslateNames([]string{"grp"}, nil); err == nil {
+		t.Error("connected to a server with an untrusted certificate")
+	}
+	if _, err := newTestAPI(t, server.URL, WithInsecureSkipVerify()).TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Errorf("TranslateNames() with insecure set failed: %v", err)
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	server := newTLSServer(func(c *tls.Config) {
+		c.MinVersion = tls.VersionTLS10
+		c.MaxVersion = tls.VersionTLS11
+	})
+	defer server.Close()
+
+	_, err := newTestAPI(t, server.URL, WithInsecureSkipVerify()).TranslateNames([]string{"grp"}, nil)
+	if err == nil {
+		t.Error("connected to a TLS 1.1 server with the default min-tls-version")
+	}
+
+	modern := newTLSServer(nil)
+	defer modern.Close()
+	withTLS13 := func(c *Config) { c.MinTLSVersion = "1.3" }
+	if _, err := newTestAPI(t, modern.URL, WithInsecureSkipVerify(), withTLS13).TranslateNames([]string{"grp"}, nil); err != nil {
+		t.Errorf("TranslateNames() with min-tls-version 1.3 failed: %v", err)
+	}
+}
@@ -0,0 +1,430 @@
+package userapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	tokenFileName = ".cacophony-token"
+	// xdgTokenFileName is the token file name in XDG_CONFIG_HOME
+	xdgTokenFileName = "cacophony-token"
+	tokenFileMode    = 0600
+	// refreshLockTimeout is how long to wait for another process to finish
+	// authenticating, this includes the time taken to enter a password
+	refreshLockTimeout = 2 * time.Minute
+
+	FileTokenStore    = "file"
+	KeyringTokenStore = "keyring"
+)
+
+// tokenConfigVersion is the current version of TokenConfig, token configs
+// without a version are version 0
+const tokenConfigVersion = 1
+
+type TokenConfig struct {
+	Version   int    `yaml:"version,omitempty"`
+	ServerURL string `yaml:"server-url,omitempty"`
+	UserName  string `yaml:"user-name"`
+	Token     string `yaml:"token"`
+	UserID    int    `yaml:"user-id,omitempty"`
+}
+
+// matches returns true if the token config is for username on serverURL,
+// tokens saved without a server are assumed to be for serverURL
+func (t *TokenConfig) matches(serverURL, username string) bool {
+	return t.UserName == username && (t.ServerURL == "" || t.ServerURL == serverURL)
+}
+
+// migrate upgrades a token config from an older version, returning true if
+// it was changed
+func (t *TokenConfig) migrate() bool {
+	if t.Version >= tokenConfigVersion {
+		return false
+	}
+	if t.Version < 1 {
+		// version 0 tokens may have been saved without the JWT scheme
+		t.Token = jwtToken(t.Token)
+	}
+	t.Version = tokenConfigVersion
+	return true
+}
+
+// TokenConfigs are the tokens saved for each server and user
+type TokenConfigs struct {
+	Tokens []TokenConfig `yaml:"tokens"`
+}
+
+// tokenFile is the format TokenConfigs are read in, tokens saved before a
+// token was kept for each server are a single token at the top level
+type tokenFile struct {
+	TokenConfig `yaml:",inline"`
+	Tokens      []TokenConfig `yaml:"tokens,omitempty"`
+}
+
+// parseTokenConfigs parses saved tokens, including a single token saved by an
+// older version
+func parseTokenConfigs(buf []byte) (*TokenConfigs, error) {
+	var file tokenFile
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return &TokenConfigs{}, err
+	}
+	tokens := &TokenConfigs{Tokens: file.Tokens}
+	if file.Token != "" {
+		tokens.Tokens = append(tokens.Tokens, file.TokenConfig)
+	}
+	return tokens, nil
+}
+
+// find returns the token saved for username on serverURL, or nil if there
+// isn't one. A token saved without a server is only used if no token is
+// saved for serverURL
+func (t *TokenConfigs) find(serverURL, username string) *TokenConfig {
+	var found *TokenConfig
+	for i := range t.Tokens {
+		token := &t.Tokens[i]
+		if token.Token == "" || !token.matches(serverURL, username) {
+			continue
+		}
+		if token.ServerURL == serverURL {
+			return token
+		}
+		found = token
+	}
+	return found
+}
+
+// set saves tokenConfig in place of the token for the same server and user,
+// and of a token for the user saved without a server
+func (t *TokenConfigs) set(tokenConfig TokenConfig) {
+	var tokens []TokenConfig
+	for _, token := range t.Tokens {
+		if !token.matches(tokenConfig.ServerURL, tokenConfig.UserName) {
+			tokens = append(tokens, token)
+		}
+	}
+	t.Tokens = append(tokens, tokenConfig)
+}
+
+// mismatch lists the saved tokens when none are for username on serverURL,
+// or returns "" if there is one or there aren't any saved tokens
+func (t *TokenConfigs) mismatch(serverURL, username string) string {
+	if t.find(serverURL, username) != nil {
+		return ""
+	}
+	var saved []string
+	for _, token := range t.Tokens {
+		if token.Token == "" {
+			continue
+		}
+		if token.ServerURL == "" {
+			saved = append(saved, token.UserName)
+		} else {
+			saved = append(saved, token.UserName+" on "+token.ServerURL)
+		}
+	}
+	if len(saved) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("no token is saved for %v on %v, tokens are saved for %v, check user-name and server-url or use --user and --server",
+		username, serverURL, strings.Join(saved, ", "))
+}
+
+// outdated returns true if any token was saved by an older version
+func (t *TokenConfigs) outdated() bool {
+	for _, token := range t.Tokens {
+		if token.Token != "" && token.Version < tokenConfigVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// migrate upgrades tokens saved by older versions, returning true if any
+// were changed
+func (t *TokenConfigs) migrate() bool {
+	changed := false
+	for i := range t.Tokens {
+		if t.Tokens[i].Token != "" && t.Tokens[i].migrate() {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// TokenStore reads and saves the users tokens
+type TokenStore interface {
+	ReadTokens() (*TokenConfigs, error)
+	// UpdateTokens reads the tokens and saves them if update returns true,
+	// without another process saving tokens in between
+	UpdateTokens(update func(*TokenConfigs) bool) (*TokenConfigs, error)
+}
+
+// tokenStore returns the configured TokenStore, tokens are saved to a file
+// by default
+func (c *Config) tokenStore() TokenStore {
+	if c.NoSaveToken {
+		return &memoryTokenStore{}
+	}
+	if c.TokenStore == KeyringTokenStore {
+		return &keyringTokenStore{keyring: systemKeyring{}}
+	}
+	return fileTokenStore{}
+}
+
+// readTokenConfigs reads the tokens from store, tokens from an older version
+// are migrated and saved back to store
+func readTokenConfigs(store TokenStore) (*TokenConfigs, error) {
+	tokens, err := store.ReadTokens()
+	if err != nil || !tokens.outdated() {
+		return tokens, err
+	}
+	// the tokens are read again while they are locked so that a token another
+	// process saved since isn't overwritten
+	migrated, err := store.UpdateTokens(func(t *TokenConfigs) bool {
+		return t.migrate()
+	})
+	if err != nil {
+		// the migrated tokens can still be used if they can't be saved
+		tokens.migrate()
+		return tokens, nil
+	}
+	return migrated, nil
+}
+
+// saveTokenConfig saves the token for username on serverURL to store, keeping
+// the tokens saved for other servers and users
+func saveTokenConfig(store TokenStore, serverURL, token, username string, userID int) error {
+	_, err := store.UpdateTokens(func(t *TokenConfigs) bool {
+		t.set(TokenConfig{
+			Version:   tokenConfigVersion,
+			ServerURL: serverURL,
+			UserName:  username,
+			Token:     token,
+			UserID:    userID,
+		})
+		return true
+	})
+	return err
+}
+
+// memoryTokenStore keeps the tokens in memory for the life of the process,
+// it is used when tokens shouldn't be saved
+type memoryTokenStore struct {
+	tokens TokenConfigs
+}
+
+func (m *memoryTokenStore) ReadTokens() (*TokenConfigs, error) {
+	return &TokenConfigs{Tokens: append([]TokenConfig(nil), m.tokens.Tokens...)}, nil
+}
+
+func (m *memoryTokenStore) UpdateTokens(update func(*TokenConfigs) bool) (*TokenConfigs, error) {
+	tokens, _ := m.ReadTokens()
+	if update(tokens) {
+		m.tokens.Tokens = append([]TokenConfig(nil), tokens.Tokens...)
+	}
+	return tokens, nil
+}
+
+// fileTokenStore saves the tokens to a file in the users home
+// directory, or in XDG_CONFIG_HOME if it is set
+type fileTokenStore struct{}
+
+// tokenFilePath returns the path the token is read from
+func tokenFilePath() (string, error) {
+	readPath, _, err := configFilePaths(tokenFileName, xdgTokenFileName)
+	return readPath, err
+}
+
+// tokenSavePath returns the path the token is saved to
+func tokenSavePath() (string, error) {
+	_, savePath, err := configFilePaths(tokenFileName, xdgTokenFileName)
+	return savePath, err
+}
+
+// ReadTokens acquires a readlock and reads the tokens
+func (fileTokenStore) ReadTokens() (*TokenConfigs, error) {
+	tokenPath, err := tokenFilePath()
+	if err != nil {
+		return &TokenConfigs{}, err
+	}
+	return readTokenFile(NewLockSafeConfig(tokenPath))
+}
+
+// readTokenFile reads the tokens from lockSafeConfig, acquiring a readlock
+// unless it is already locked, a missing file has no tokens
+func readTokenFile(lockSafeConfig *LockSafeConfig) (*TokenConfigs, error) {
+	if err := checkTokenPermissions(lockSafeConfig.filename); err != nil {
+		return &TokenConfigs{}, err
+	}
+	return parseTokenFile(lockSafeConfig)
+}
+
+// parseTokenFile reads the tokens from lockSafeConfig without checking its
+// permissions, this is only used to keep the other tokens when saving
+func parseTokenFile(lockSafeConfig *LockSafeConfig) (*TokenConfigs, error) {
+	bytes, err := lockSafeConfig.Read()
+	if err == ErrConfigMissing {
+		return &TokenConfigs{}, nil
+	} else if err != nil {
+		return &TokenConfigs{}, err
+	}
+	return parseTokenConfigs(bytes)
+}
+
+// checkTokenPermissions returns an error if the token file is accessible by
+// anyone other than the owner, the token is then ignored until a new token
+// is saved, which rewrites the file with the right permissions. This check is
+// skipped on windows
+func checkTokenPermissions(tokenPath string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	info, err := Fs.Stat(tokenPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if mode := info.Mode().Perm(); mode&^tokenFileMode != 0 {
+		return fmt.Errorf("permissions %#o for %v are too open (should be %#o)",
+			mode, tokenPath, tokenFileMode)
+	}
+	return nil
+}
+
+// UpdateTokens acquires a exlock which is held while the tokens are read,
+// updated and saved. A token file with permissions that are too open is
+// still read, so its other tokens are kept when it is saved as tokenFileMode
+func (fileTokenStore) UpdateTokens(update func(*TokenConfigs) bool) (*TokenConfigs, error) {
+	lockSafeConfig, err := exLockTokenFile()
+	if err != nil {
+		return nil, err
+	}
+	defer lockSafeConfig.Unlock()
+	readPath, err := tokenFilePath()
+	if err != nil {
+		return nil, err
+	}
+	readConfig := lockSafeConfig
+	if readPath != lockSafeConfig.filename {
+		// the token hasn't been saved to XDG_CONFIG_HOME yet
+		readConfig = NewLockSafeConfig(readPath)
+	}
+	tokens, err := parseTokenFile(readConfig)
+	if err != nil {
+		return nil, err
+	}
+	if !update(tokens) {
+		return tokens, nil
+	}
+	return tokens, writeTokenFile(lockSafeConfig, tokens)
+}
+
+// exLockTokenFile returns the token file that tokens are saved to with an
+// exclusive lock acquired, Unlock must be called to release it
+func exLockTokenFile() (*LockSafeConfig, error) {
+	tokenPath, err := tokenSavePath()
+	if err != nil {
+		return nil, err
+	}
+	if err := makeConfigDir(tokenPath); err != nil {
+		return nil, err
+	}
+	lockSafeConfig := NewLockSafeConfig(tokenPath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return nil, err
+	}
+	return lockSafeConfig, nil
+}
+
+// writeTokenFile writes tokens to the exclusively locked lockSafeConfig
+func writeTokenFile(lockSafeConfig *LockSafeConfig, tokens *TokenConfigs) error {
+	buf, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	// WriteFile only sets the mode of new files, so the mode of an existing
+	// file is fixed before the token is written to it
+	err = Fs.Chmod(lockSafeConfig.filename, tokenFileMode)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return lockSafeConfig.Write(buf)
+}
+
+// LockTokenRefresh acquires an exclusive lock that is held while
+// authenticating and saving a new token, so that processes authenticating at
+// the same time can use the token saved by the first, unlock must be called
+// to release it
+func (api *CacophonyUserAPI) LockTokenRefresh() (unlock func(), err error) {
+	tokenPath, err := tokenSavePath()
+	if err != nil {
+		return nil, err
+	}
+	if err := makeConfigDir(tokenPath); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(tokenPath + ".refresh.lock")
+	lockCtx, cancel := context.WithTimeout(context.Background(), refreshLockTimeout)
+	defer cancel()
+	if _, err := fileLock.TryLockContext(lockCtx, lockRetryDelay()); err != nil {
+		return nil, err
+	}
+	return func() { fileLock.Unlock() }, nil
+}
+
+// ReloadToken re-reads the saved token and uses it if another process has
+// saved a different token for this user that hasn't expired, returning true
+// if the token was replaced
+func (api *CacophonyUserAPI) ReloadToken() bool {
+	tokens, err := readTokenConfigs(api.tokenStore)
+	if err != nil {
+		return false
+	}
+	tokenConfig := tokens.find(api.serverURL, api.username)
+	if tokenConfig == nil {
+		return false
+	}
+	if tokenConfig.Token == api.token || tokenConfig.Token == jwtToken(api.token) {
+		return false
+	}
+	if expiry, err := tokenExpiry(tokenConfig.Token); err == nil && !expiry.IsZero() && time.Now().After(expiry) {
+		return false
+	}
+	api.token = tokenConfig.Token
+	api.userID = tokenConfig.UserID
+	api.logger.Debugf("using the token saved by another process")
+	return true
+}
+
+// tokenExpiry returns the expiry time from the exp claim of a JWT token
+func tokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(strings.TrimPrefix(token, jwtScheme), ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not decode token: %v", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("could not decode token: %v", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,385 @@
+package userapi
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const testServer = "https://api.example.com"
+
+func TestFileTokenStoreSave(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	tokenPath := path.Join(home, tokenFileName)
+	writeFile(t, tokenPath, "tokens:\n- version: 1\n  server-url: https://test.example.com\n  user-name: user\n  token: JWT test\n", 0600)
+
+	if err := saveTokenConfig(fileTokenStore{}, testServer, "JWT new", "user", 7); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != tokenFileMode {
+		t.Errorf("token file mode = %#o, want %#o", info.Mode().Perm(), tokenFileMode)
+	}
+	tokens, err := fileTokenStore{}.ReadTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.Tokens) != 2 {
+		t.Fatalf("saved tokens = %+v, the token for the other server should be kept", tokens.Tokens)
+	}
+	if found := tokens.find(testServer, "user"); found == nil || found.Token != "JWT new" || found.UserID != 7 {
+		t.Errorf("saved token = %+v", found)
+	}
+}
+
+func TestCheckTokenPermissions(t *testing.T) {
+	previous := Fs
+	defer func() { Fs = previous }()
+	Fs = afero.NewMemMapFs()
+	tokenPath := "/home/user/" + tokenFileName
+
+	if err := checkTokenPermissions(tokenPath); err != nil {
+		t.Errorf("checkTokenPermissions() of a missing file = %v", err)
+	}
+	afero.WriteFile(Fs, tokenPath, []byte("token: JWT saved\n"), 0600)
+	if err := checkTokenPermissions(tokenPath); err != nil {
+		t.Errorf("checkTokenPermissions() of a 0600 file = %v", err)
+	}
+	for _, mode := range []os.FileMode{0644, 0660, 0604} {
+		Fs.Chmod(tokenPath, mode)
+		err := checkTokenPermissions(tokenPath)
+		if err == nil || !strings.Contains(err.Error(), "too open") {
+			t.Errorf("checkTokenPermissions() of a %#o file = %v", mode, err)
+		}
+	}
+}
+
+func TestNewConfigInsecureTokenFile(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	writeFile(t, path.Join(home, userConfig), "server-url: "+testServer+"\nuser-name: user\n", 0600)
+	tokenPath := path.Join(home, tokenFileName)
+	writeFile(t, tokenPath, "tokens:\n- version: 1\n  user-name: user\n  token: JWT saved\n- version: 1\n  user-name: other\n  token: JWT other\n", 0644)
+
+	conf, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.token != "" || conf.TokenError() == nil {
+		t.Errorf("token from an insecure file = %q, error = %v", conf.token, conf.TokenError())
+	}
+
+	// saving a new token rewrites the file with the right permissions,
+	// keeping the other tokens in it
+	if err := saveTokenConfig(fileTokenStore{}, testServer, "JWT new", "user", 0); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(tokenPath); err != nil || info.Mode().Perm() != tokenFileMode {
+		t.Errorf("token file after saving = %v, %v", info, err)
+	}
+	tokens, err := fileTokenStore{}.ReadTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := tokens.find(testServer, "other"); found == nil || found.Token != "JWT other" {
+		t.Errorf("the other users token was lost: %+v", tokens.Tokens)
+	}
+	if conf, err = NewConfig(); err != nil || conf.TokenError() != nil || conf.token != "JWT new" {
+		t.Errorf("NewConfig() = %q, %v, %v", conf.token, err, conf.TokenError())
+	}
+}
+
+func TestSaveTokenReadOnlyFs(t *testing.T) {
+	_, cleanup := tempHome(t)
+	defer cleanup()
+	previous := Fs
+	defer func() { Fs = previous }()
+	Fs = afero.NewReadOnlyFs(afero.NewOsFs())
+
+	if err := saveTokenConfig(fileTokenStore{}, testServer, "JWT new", "user", 0); err == nil {
+		t.Error("saveTokenConfig() on a read only filesystem succeeded")
+	}
+}
+
+// failingTokenStore fails to save tokens
+type failingTokenStore struct {
+	memoryTokenStore
+}
+
+func (failingTokenStore) UpdateTokens(update func(*TokenConfigs) bool) (*TokenConfigs, error) {
+	return nil, errors.New("disk full")
+}
+
+// testToken returns a JWT token that expires at expiry
+func testToken(expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, expiry.Unix())))
+	return jwtScheme + "header." + payload + ".signature"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	got, err := tokenExpiry(testToken(expiry))
+	if err != nil || !got.Equal(expiry) {
+		t.Errorf("tokenExpiry() = %v, %v, want %v", got, err, expiry)
+	}
+	if _, err := tokenExpiry("JWT not-a-jwt"); err == nil {
+		t.Error("tokenExpiry() of an invalid token succeeded")
+	}
+
+	api := &CacophonyUserAPI{token: testToken(time.Now().Add(-time.Minute))}
+	if !api.TokenExpired() || !api.NeedsAuthentication() {
+		t.Error("an expired token should need authentication")
+	}
+	api.token = testToken(time.Now().Add(time.Hour))
+	if api.TokenExpired() || api.NeedsAuthentication() {
+		t.Error("a valid token shouldn't need authentication")
+	}
+}
+
+func TestReloadToken(t *testing.T) {
+	store := &memoryTokenStore{}
+	api := &CacophonyUserAPI{
+		serverURL:  testServer,
+		username:   "user",
+		token:      "JWT old",
+		tokenStore: store,
+		logger:     defaultLogger(),
+	}
+	if api.ReloadToken() {
+		t.Error("ReloadToken() without a saved token succeeded")
+	}
+	saveTokenConfig(store, testServer, testToken(time.Now().Add(-time.Minute)), "user", 1)
+	if api.ReloadToken() {
+		t.Error("ReloadToken() used an expired token")
+	}
+	saved := testToken(time.Now().Add(time.Hour))
+	saveTokenConfig(store, testServer, saved, "user", 2)
+	if !api.ReloadToken() || api.token != saved || api.userID != 2 {
+		t.Errorf("ReloadToken() token = %q, user id = %v", api.token, api.userID)
+	}
+	if api.ReloadToken() {
+		t.Error("ReloadToken() of the same token succeeded")
+	}
+}
+
+func TestLockTokenRefresh(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	api := &CacophonyUserAPI{}
+	unlock, err := api.LockTokenRefresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(home, tokenFileName+".refresh.lock")); err != nil {
+		t.Errorf("refresh lock wasn't created: %v", err)
+	}
+	unlock()
+	unlock, err = api.LockTokenRefresh()
+	if err != nil {
+		t.Fatalf("LockTokenRefresh() after unlocking failed: %v", err)
+	}
+	unlock()
+}
+
+func TestNoSaveToken(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	conf, err := NewConfig(WithServerURL(testServer), WithUserName("user"), WithNoSaveToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := conf.tokenStore()
+	if err := saveTokenConfig(store, testServer, "JWT new", "user", 0); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, _ := store.ReadTokens(); tokens.find(testServer, "user") == nil {
+		t.Error("token was not kept in memory")
+	}
+	if _, err := os.Stat(path.Join(home, tokenFileName)); !os.IsNotExist(err) {
+		t.Errorf("token file was written: %v", err)
+	}
+}
+
+func TestFileTokenStoreMigrate(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	tokenPath := path.Join(home, tokenFileName)
+	writeFile(t, tokenPath, "user-name: user\ntoken: legacy\n", 0600)
+
+	tokens, err := readTokenConfigs(fileTokenStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TokenConfig{{Version: tokenConfigVersion, UserName: "user", Token: "JWT legacy"}}
+	if !reflect.DeepEqual(tokens.Tokens, want) {
+		t.Errorf("migrated tokens = %+v, want %+v", tokens.Tokens, want)
+	}
+	saved, err := fileTokenStore{}.ReadTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.outdated() || !reflect.DeepEqual(saved.Tokens, want) {
+		t.Errorf("migrated tokens weren't saved: %+v", saved.Tokens)
+	}
+}
+
+func TestReadTokenConfigsMigrateFails(t *testing.T) {
+	store := &failingTokenStore{}
+	store.tokens.Tokens = []TokenConfig{{UserName: "user", Token: "legacy"}}
+	tokens, err := readTokenConfigs(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := tokens.find(testServer, "user"); found == nil || found.Token != "JWT legacy" {
+		t.Errorf("tokens weren't migrated in memory: %+v", tokens.Tokens)
+	}
+}
+
+func TestTokenConfigsFind(t *testing.T) {
+	tokens := &TokenConfigs{Tokens: []TokenConfig{
+		{UserName: "user", Token: "JWT legacy"},
+		{ServerURL: testServer, UserName: "user", Token: "JWT server"},
+		{ServerURL: testServer, UserName: "other", Token: "JWT other"},
+		{ServerURL: "https://test.example.com", UserName: "user", Token: ""},
+	}}
+	tests := []struct {
+		serverURL string
+		username  string
+		want      string
+	}{
+		{testServer, "user", "JWT server"},
+		{testServer, "other", "JWT other"},
+		{"https://test.example.com", "user", "JWT legacy"},
+		{testServer, "nobody", ""},
+	}
+	for _, test := range tests {
+		var token string
+		if found := tokens.find(test.serverURL, test.username); found != nil {
+			token = found.Token
+		}
+		if token != test.want {
+			t.Errorf("find(%v, %v) = %q, want %q", test.serverURL, test.username, token, test.want)
+		}
+	}
+}
+
+func TestTokenConfigsSet(t *testing.T) {
+	tokens := &TokenConfigs{Tokens: []TokenConfig{
+		{UserName: "user", Token: "JWT legacy"},
+		{ServerURL: testServer, UserName: "other", Token: "JWT other"},
+		{ServerURL: "https://test.example.com", UserName: "user", Token: "JWT test"},
+	}}
+	tokens.set(TokenConfig{ServerURL: testServer, UserName: "user", Token: "JWT new"})
+	want := []TokenConfig{
+		{ServerURL: testServer, UserName: "other", Token: "JWT other"},
+		{ServerURL: "https://test.example.com", UserName: "user", Token: "JWT test"},
+		{ServerURL: testServer, UserName: "user", Token: "JWT new"},
+	}
+	if !reflect.DeepEqual(tokens.Tokens, want) {
+		t.Errorf("set() tokens = %+v, want %+v", tokens.Tokens, want)
+	}
+}
+
+func TestTokenConfigsMismatch(t *testing.T) {
+	tokens := &TokenConfigs{Tokens: []TokenConfig{
+		{ServerURL: testServer, UserName: "user", Token: "JWT server"},
+	}}
+	if mismatch := tokens.mismatch(testServer, "user"); mismatch != "" {
+		t.Errorf("mismatch() for a saved token = %q", mismatch)
+	}
+	mismatch := tokens.mismatch(testServer, "other")
+	if !strings.Contains(mismatch, "user on "+testServer) || !strings.Contains(mismatch, "--user") {
+		t.Errorf("mismatch() = %q", mismatch)
+	}
+	if mismatch := (&TokenConfigs{}).mismatch(testServer, "user"); mismatch != "" {
+		t.Errorf("mismatch() without saved tokens = %q", mismatch)
+	}
+}
+
+func TestNewConfigReadsToken(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	writeFile(t, path.Join(home, userConfig), "server-url: "+testServer+"\nuser-name: user\n", 0600)
+	writeFile(t, path.Join(home, tokenFileName),
+		"tokens:\n- version: 1\n  server-url: "+testServer+"\n  user-name: user\n  token: JWT saved\n  user-id: 3\n", 0600)
+
+	conf, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.token != "JWT saved" || conf.userID != 3 || conf.TokenMismatch() != "" {
+		t.Errorf("token = %q, user id = %v, mismatch = %q", conf.token, conf.userID, conf.TokenMismatch())
+	}
+
+	conf, err = NewConfig(WithUserName("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.token != "" || conf.TokenMismatch() == "" {
+		t.Errorf("token for another user = %q, mismatch = %q", conf.token, conf.TokenMismatch())
+	}
+}
+
+func TestXDGTokenFile(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	xdgHome := path.Join(home, ".config")
+	defer setEnv("XDG_CONFIG_HOME", xdgHome)()
+	writeFile(t, path.Join(home, tokenFileName),
+		"tokens:\n- version: 1\n  server-url: https://test.example.com\n  user-name: user\n  token: JWT test\n", 0600)
+
+	if err := saveTokenConfig(fileTokenStore{}, testServer, "JWT new", "user", 0); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(xdgHome, xdgConfigDir, xdgTokenFileName))
+	if err != nil {
+		t.Fatalf("token wasn't saved to XDG_CONFIG_HOME: %v", err)
+	}
+	tokens, err := parseTokenConfigs(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.Tokens) != 2 {
+		t.Errorf("tokens from the home directory weren't kept: %+v", tokens.Tokens)
+	}
+}
+
+func TestNewConfigTokenEnv(t *testing.T) {
+	home, cleanup := tempHome(t)
+	defer cleanup()
+	writeFile(t, path.Join(home, userConfig), "server-url: "+testServer+"\nuser-name: user\n", 0600)
+	writeFile(t, path.Join(home, tokenFileName),
+		"tokens:\n- version: 1\n  server-url: "+testServer+"\n  user-name: user\n  token: JWT saved\n", 0600)
+	defer setEnv(TokenEnv, "env")()
+
+	conf, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.token != "JWT env" {
+		t.Errorf("token = %q, want the token from %v", conf.token, TokenEnv)
+	}
+	if !conf.NoSaveToken {
+		t.Errorf("a token from %v should not be saved", TokenEnv)
+	}
+
+	// the env token is used even when there is no config
+	os.Remove(path.Join(home, userConfig))
+	conf, err = NewConfig()
+	if err != ErrConfigMissing || conf.token != "JWT env" {
+		t.Errorf("NewConfig() without a config = %q, %v", conf.token, err)
+	}
+}
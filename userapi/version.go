@@ -0,0 +1,150 @@
+package userapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrServerVersionUnknown is returned when server-version-path isn't set or
+// the server doesn't report its version
+var ErrServerVersionUnknown = errors.New("the server version is unknown")
+
+// ErrUnsupportedVersion is returned when the server version is outside
+// min-server-version and max-server-version
+var ErrUnsupportedVersion = errors.New("server version is not supported")
+
+type versionResponse struct {
+	Version string `json:"version"`
+}
+
+// ServerVersion returns the version reported by the server at
+// server-version-path, the version is only requested once and the result,
+// including any error, is reused
+func (api *CacophonyUserAPI) ServerVersion() (string, error) {
+	api.versionOnce.Do(func() {
+		api.serverVersion, api.serverVersionErr = api.requestServerVersion()
+	})
+	return api.serverVersion, api.serverVersionErr
+}
+
+func (api *CacophonyUserAPI) requestServerVersion() (string, error) {
+	if api.versionPath == "" {
+		return "", ErrServerVersionUnknown
+	}
+	versionURL, err := joinURL(api.serverURL, api.versionPath)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", versionURL, nil)
+	if err != nil {
+		return "", err
+	}
+	api.setRequestID(req)
+	api.setOrg(req)
+	req, cancel := api.withTimeout(req)
+	defer cancel()
+	resp, err := api.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrServerVersionUnknown
+	}
+	if err := handleHTTPResponse(resp); err != nil {
+		return "", err
+	}
+	var versionResp versionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&versionResp); err != nil {
+		return "", fmt.Errorf("decode: %v", err)
+	}
+	if versionResp.Version == "" {
+		return "", ErrServerVersionUnknown
+	}
+	return versionResp.Version, nil
+}
+
+// CheckServerVersion returns an error wrapping ErrUnsupportedVersion if the
+// server version is outside min-server-version and max-server-version, or
+// ErrServerVersionUnknown if the version isn't known
+func (api *CacophonyUserAPI) CheckServerVersion() error {
+	version, err := api.ServerVersion()
+	if err != nil {
+		return err
+	}
+	if !versionSupported(version, api.minVersion, api.maxVersion) {
+		return fmt.Errorf("%w: %v, csalt supports %v", ErrUnsupportedVersion, version,
+			versionRange(api.minVersion, api.maxVersion))
+	}
+	return nil
+}
+
+// versionSupported returns true if version is at least min and before max,
+// an empty min or max isn't checked and versions that can't be parsed are
+// assumed to be supported
+func versionSupported(version, min, max string) bool {
+	parsed, ok := parseVersion(version)
+	if !ok {
+		return true
+	}
+	if minVersion, ok := parseVersion(min); ok && compareVersions(parsed, minVersion) < 0 {
+		return false
+	}
+	if maxVersion, ok := parseVersion(max); ok && compareVersions(parsed, maxVersion) >= 0 {
+		return false
+	}
+	return true
+}
+
+// versionRange describes the supported versions from min up to max
+func versionRange(min, max string) string {
+	switch {
+	case min == "":
+		return "versions before " + max
+	case max == "":
+		return min + " and later"
+	default:
+		return min + " up to " + max
+	}
+}
+
+// parseVersion parses a major.minor.patch version, with an optional v
+// prefix and missing parts treated as 0
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if version == "" {
+		return parsed, false
+	}
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > len(parsed) {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// compareVersions returns -1, 0 or 1 if a is before, the same as or after b
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package userapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testVersionPath = "/api/v1/version"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		ok      bool
+	}{
+		{"1.2.3", [3]int{1, 2, 3}, true},
+		{"v2.0", [3]int{2, 0, 0}, true},
+		{" 2 ", [3]int{2, 0, 0}, true},
+		{"2.1.0-beta+build", [3]int{2, 1, 0}, true},
+		{"", [3]int{}, false},
+		{"1.2.3.4", [3]int{}, false},
+		{"nightly", [3]int{}, false},
+		{"1.-2", [3]int{}, false},
+	}
+	for _, test := range tests {
+		parsed, ok := parseVersion(test.version)
+		if ok != test.ok || (ok && parsed != test.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", test.version, parsed, ok, test.want, test.ok)
+		}
+	}
+}
+
+// newVersionAPI returns an api for serverURL that reads the version from
+// testVersionPath and supports min up to max
+func newVersionAPI(t *testing.T, serverURL, min, max string) *CacophonyUserAPI {
+	return newTestAPI(t, serverURL, func(c *Config) {
+		c.ServerVersionPath = testVersionPath
+		c.MinServerVersion = min
+		c.MaxServerVersion = max
+	})
+}
+
+func TestCheckServerVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		min, max  string
+		supported bool
+	}{
+		{"1.0.0", "1.0.0", "3.0.0", true},
+		{"v2.9.9", "1.0.0", "3.0.0", true},
+		{"0.9.1", "1.0.0", "3.0.0", false},
+		{"3.0.0", "1.0.0", "3.0.0", false},
+		{"nightly", "1.0.0", "3.0.0", true},
+		{"9.0.0", "1.0.0", "", true},
+		{"0.1.0", "", "3.0.0", true},
+		{"0.1.0", "", "", true},
+	}
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.URL.Path != testVersionPath {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, versionResponse{Version: test.version})
+		}))
+		api := newVersionAPI(t, server.URL, test.min, test.max)
+		err := api.CheckServerVersion()
+		if (err == nil) != test.supported || (err != nil && !errors.Is(err, ErrUnsupportedVersion)) {
+			t.Errorf("CheckServerVersion() for %v in %v-%v = %v", test.version, test.min, test.max, err)
+		}
+		if version, err := api.ServerVersion(); err != nil || version != test.version {
+			t.Errorf("ServerVersion() = %v, %v", version, err)
+		}
+		if requests != 1 {
+			t.Errorf("version requested %d times, it should only be requested once", requests)
+		}
+		server.Close()
+	}
+}
+
+func TestServerVersionUnknown(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		wantReq int
+	}{
+		{"no path", "", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, versionResponse{Version: "1.0.0"})
+		}, 0},
+		{"not found", testVersionPath, http.NotFound, 1},
+		{"no version", testVersionPath, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]string{})
+		}, 1},
+	}
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			test.handler(w, r)
+		}))
+		api := newTestAPI(t, server.URL, func(c *Config) {
+			c.ServerVersionPath = test.path
+			c.MinServerVersion = "1.0.0"
+		})
+		for i := 0; i < 2; i++ {
+			if err := api.CheckServerVersion(); !errors.Is(err, ErrServerVersionUnknown) {
+				t.Errorf("%v: CheckServerVersion() = %v, want %v", test.name, err, ErrServerVersionUnknown)
+			}
+		}
+		if requests != test.wantReq {
+			t.Errorf("%v: version requested %d times, want %d", test.name, requests, test.wantReq)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package userapi
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// xdgConfigDir is the directory in XDG_CONFIG_HOME that csalt saves its
+// config and token to
+const xdgConfigDir = "csalt"
+
+// xdgConfigHome returns $XDG_CONFIG_HOME/csalt, or "" if XDG_CONFIG_HOME isn't
+// set to an absolute path
+func xdgConfigHome() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" || !filepath.IsAbs(configHome) {
+		return ""
+	}
+	return path.Join(configHome, xdgConfigDir)
+}
+
+// configFilePaths returns the path a config file is read from and the path it
+// is saved to. When XDG_CONFIG_HOME is set files are saved to
+// $XDG_CONFIG_HOME/csalt/xdgName, and are read from homeName in the home
+// directory until they have been saved there
+func configFilePaths(homeName, xdgName string) (readPath, savePath string, err error) {
+	homeDir, err := userHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	homePath := path.Join(homeDir, homeName)
+	xdgHome := xdgConfigHome()
+	if xdgHome == "" {
+		return homePath, homePath, nil
+	}
+	savePath = path.Join(xdgHome, xdgName)
+	if _, err := Fs.Stat(savePath); os.IsNotExist(err) {
+		return homePath, savePath, nil
+	}
+	return savePath, savePath, nil
+}
+
+// makeConfigDir creates the directory filePath is saved in if it doesn't exist
+func makeConfigDir(filePath string) error {
+	return Fs.MkdirAll(path.Dir(filePath), 0700)
+}